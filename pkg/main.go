@@ -17,7 +17,11 @@ func main() {
 	// from Grafana to create different instances of SampleDatasource (per datasource
 	// ID). When datasource configuration changed Dispose method will be called and
 	// new datasource instance created using NewSampleDatasource factory.
-	if err := datasource.Manage("criblcloud-search-datasource", plugin.NewDatasource, datasource.ManageOpts{}); err != nil {
+	err := datasource.Manage("criblcloud-search-datasource", plugin.NewDatasource, datasource.ManageOpts{})
+	// Manage returns once the plugin is shut down (by Grafana, or a signal), cancel any jobs still
+	// running on Cribl on the way out
+	plugin.DisposeAll()
+	if err != nil {
 		log.DefaultLogger.Error(err.Error())
 		os.Exit(1)
 	}
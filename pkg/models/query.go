@@ -1,10 +1,54 @@
 package models
 
 /**
- * Query used with Cribl Search.  Can either use a saved search or run an adhoc query.
+ * Query used with Cribl Search.  Can either use a saved search, run an adhoc query, fetch the results of an existing job,
+ * or list the search job history.
  */
 type CriblQuery struct {
-	Type          string `json:"type"`          // either "adhoc" or "saved"
-	Query         string `json:"query"`         // Ad-hoc query (Kusto), when Type is "adhoc"
-	SavedSearchId string `json:"savedSearchId"` // ID of the Cribl saved search, when Type is "saved"
+	Type            string `json:"type"`            // "adhoc", "saved", "job" or "jobs"
+	Query           string `json:"query"`           // Ad-hoc query (Kusto), when Type is "adhoc"
+	SavedSearchId   string `json:"savedSearchId"`   // ID of the Cribl saved search, when Type is "saved"
+	SavedSearchMode string `json:"savedSearchMode"` // "cached" (default), "savedRange" or "dashboardRange", when Type is "saved"
+
+	JobId      string `json:"jobId"`                // ID of an existing Cribl job, when Type is "job"
+	JobsStatus string `json:"jobsStatus,omitempty"` // Only list jobs with this status (i.e. "completed"), when Type is "jobs"
+	JobsUser   string `json:"jobsUser,omitempty"`   // Only list jobs run by this user, when Type is "jobs"
+
+	SavedSearchFreshness string        `json:"savedSearchFreshness"`   // for cached saved search results: "" (default), "maxAge", "cacheOnly" or "always"
+	MaxAgeMinutes        float64       `json:"maxAgeMinutes"`          // for the "maxAge" freshness policy, how old cached results may be (required, more than 0)
+	AdhocFilters         []AdhocFilter `json:"adhocFilters,omitempty"` // Grafana ad hoc filters, appended as "where" clauses when Type is "adhoc"
+
+	RelativeTimeRange bool          `json:"relativeTimeRange"`      // Pass relative expressions (i.e. "-1h" / "now") to Cribl instead of absolute times, when possible
+	TimeRangeRaw      *RawTimeRange `json:"timeRangeRaw,omitempty"` // The dashboard's time range as the user expressed it, supplied by the frontend
+
+	TimeFields []string `json:"timeFields,omitempty"` // Names of fields to convert to time values, overriding the data source's default
+
+	BypassCache    bool `json:"bypassCache,omitempty"`    // Always run the query, neither using nor updating the data source's result cache
+	PartialResults bool `json:"partialResults,omitempty"` // On timeout, return the results produced so far (with a warning) instead of an error
+
+	TimeoutSec *float64 `json:"timeoutSec,omitempty"` // Overrides the data source's query timeout, capped by its max
+	JobTags    []string `json:"jobTags,omitempty"`    // Tags added to the query's breadcrumb, identifying its jobs in Cribl's job history
+
+	Incremental   bool   `json:"incremental,omitempty"`   // On refresh, only query buckets since the last refresh (requires bin()), when Type is "adhoc"
+	ChunkInterval string `json:"chunkInterval,omitempty"` // Split the time range into chunks of this size (i.e. "1d"), run as concurrent jobs, when Type is "adhoc"
+
+	FillMode     string `json:"fillMode,omitempty"`     // How to fill missing time buckets: "none" (default), "null", "zero" or "previous"
+	FillInterval string `json:"fillInterval,omitempty"` // Bucket interval for filling (i.e. "5m"), detected from bin() in the query if omitted
+}
+
+/**
+ * Raw (unparsed) Grafana time range, i.e. from="now-1h", to="now"
+ */
+type RawTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+/**
+ * A single filter from a Grafana ad hoc filter variable, i.e. key="host", operator="=", value="web01"
+ */
+type AdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"` // one of "=", "!=", "=~", "!~", "<", ">"
+	Value    string `json:"value"`
 }
@@ -8,10 +8,39 @@ import (
 )
 
 type PluginSettings struct {
-	CriblOrgBaseUrl string                `json:"criblOrgBaseUrl"`
-	ClientId        string                `json:"clientId"`
-	QueryTimeoutSec *float64              `json:"queryTimeoutSec"`
-	Secrets         *SecretPluginSettings `json:"-"`
+	CriblOrgBaseUrl    string   `json:"criblOrgBaseUrl"`
+	ClientId           string   `json:"clientId"`
+	QueryTimeoutSec    *float64 `json:"queryTimeoutSec"`
+	MaxQueryTimeoutSec *float64 `json:"maxQueryTimeoutSec"` // caps the timeout queries may choose for themselves
+	TimeFields         []string `json:"timeFields"`         // default names of fields to convert to time values, i.e. "_time"
+	MaxChunkJobs       *int     `json:"maxChunkJobs"`       // max # of concurrent jobs when a query's time range is split into chunks
+
+	HideUserInBreadcrumb bool `json:"hideUserInBreadcrumb"` // leave the Grafana user's login out of the breadcrumb appended to queries
+
+	// Who may run ad-hoc queries (and fetch jobs or the job history, which could expose anything).  If neither
+	// is set, anyone can.  Everyone else is restricted to saved searches.  Grafana doesn't tell plugins
+	// which teams a user is in, so users are allowed by role or by login.
+	AdhocMinRole string   `json:"adhocMinRole"` // min Grafana org role: "Viewer", "Editor" or "Admin"
+	AdhocUsers   []string `json:"adhocUsers"`   // logins (or emails) of users allowed regardless of their role
+
+	AllowedSavedSearchIds []string `json:"allowedSavedSearchIds"` // if set, the only saved searches which may be run
+	AllowedDatasets       []string `json:"allowedDatasets"`       // if set, the only datasets ad-hoc queries may search (wildcards allowed, i.e. "cribl_*")
+
+	AuditSink         string   `json:"auditSink"`         // where to write a record of each query: "" (nowhere), "log" or "file"
+	AuditFilePath     string   `json:"auditFilePath"`     // for the "file" sink, the JSON lines file to append to, within the directory set by GF_PLUGIN_CRIBL_AUDIT_DIR
+	AuditFileMaxMb    *float64 `json:"auditFileMaxMb"`    // rotate the file once it reaches this size
+	AuditFileMaxFiles *int     `json:"auditFileMaxFiles"` // # of rotated files kept, at least 1
+	AuditHashQuery    bool     `json:"auditHashQuery"`    // record a hash of the query text rather than the text itself
+
+	CacheTtlSec         *float64 `json:"cacheTtlSec"`         // how long query results are cached, caching is disabled if not set
+	CacheMaxMb          *float64 `json:"cacheMaxMb"`          // max total size of cached results
+	CacheGranularitySec *float64 `json:"cacheGranularitySec"` // time ranges are rounded to this for caching, so near-identical ranges share results
+
+	PollInitialDelaySec *float64 `json:"pollInitialDelaySec"` // how long to wait before first polling a running job's status
+	PollMaxBackoffSec   *float64 `json:"pollMaxBackoffSec"`   // max wait between polls, as the wait grows
+	PollJitter          *float64 `json:"pollJitter"`          // randomize each wait by up to +/- this fraction (0 to 1)
+
+	Secrets *SecretPluginSettings `json:"-"`
 }
 
 type SecretPluginSettings struct {
@@ -0,0 +1,234 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Where audit records go, see models.PluginSettings.AuditSink
+const (
+	AUDIT_SINK_NONE = ""
+	AUDIT_SINK_LOG  = "log"  // the plugin logger
+	AUDIT_SINK_FILE = "file" // an append-only JSON lines file, rotated by size
+)
+
+const DEFAULT_AUDIT_FILE_MAX_MB = 100
+const DEFAULT_AUDIT_FILE_MAX_FILES = 5 // # of rotated files kept, besides the current one
+
+// The environment variable naming the directory audit files must be in.  It's set on the Grafana server
+// (Grafana passes GF_PLUGIN_* variables to plugins), since whoever edits the data source's settings
+// shouldn't be able to pick any file the server can write to.
+const AUDIT_DIR_ENV = "GF_PLUGIN_CRIBL_AUDIT_DIR"
+
+// A record of one query executed through the data source: who ran it, against what, and how it went
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	User          string    `json:"user,omitempty"`
+	OrgID         int64     `json:"orgId,omitempty"`
+	DatasourceUID string    `json:"datasourceUid,omitempty"`
+	RefID         string    `json:"refId,omitempty"`
+	QueryType     string    `json:"queryType"`
+	Query         string    `json:"query,omitempty"`     // the prepared query text (less the breadcrumb), unless it's hashed
+	QueryHash     string    `json:"queryHash,omitempty"` // sha256 of the prepared query text, if it's hashed
+	SavedSearchId string    `json:"savedSearchId,omitempty"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	JobId         string    `json:"jobId,omitempty"`
+	Status        string    `json:"status"` // "ok" or "error"
+	Error         string    `json:"error,omitempty"`
+	EventCount    int       `json:"eventCount"`
+	DurationMs    int64     `json:"durationMs"`
+}
+
+type auditSink interface {
+	write(record *auditRecord) error
+}
+
+// Create the audit sink configured for the data source, or nil if there's no audit log
+func newAuditSink(settings *models.PluginSettings) (auditSink, error) {
+	switch settings.AuditSink {
+	case AUDIT_SINK_NONE:
+		return nil, nil
+	case AUDIT_SINK_LOG:
+		return logAuditSink{}, nil
+	case AUDIT_SINK_FILE:
+		if len(settings.AuditFilePath) == 0 {
+			return nil, fmt.Errorf("an audit file path is required to write the audit log to a file")
+		}
+		path, err := auditFilePath(os.Getenv(AUDIT_DIR_ENV), settings.AuditFilePath)
+		if err != nil {
+			return nil, err
+		}
+		sink := &fileAuditSink{path: path, maxBytes: DEFAULT_AUDIT_FILE_MAX_MB << 20, maxFiles: DEFAULT_AUDIT_FILE_MAX_FILES}
+		if settings.AuditFileMaxMb != nil && *settings.AuditFileMaxMb > 0 {
+			sink.maxBytes = int64(*settings.AuditFileMaxMb * (1 << 20))
+		}
+		if settings.AuditFileMaxFiles != nil {
+			if *settings.AuditFileMaxFiles < 1 {
+				return nil, fmt.Errorf("at least 1 rotated audit file must be kept")
+			}
+			sink.maxFiles = *settings.AuditFileMaxFiles
+		}
+		return sink, nil
+	default:
+		return nil, fmt.Errorf("unsupported audit sink: %v", settings.AuditSink)
+	}
+}
+
+// Resolve the configured audit file path, which is relative to the audit directory (or absolute, but
+// within it).  The directory's symlinks are resolved, and the file can't be the directory itself or
+// outside of it.
+func auditFilePath(dir string, path string) (string, error) {
+	if len(dir) == 0 {
+		return "", fmt.Errorf("the audit log can only be written to a file when the Grafana server sets %v to the directory for it", AUDIT_DIR_ENV)
+	}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid audit directory: %v", err.Error())
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid audit directory: %v", err.Error())
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("the audit file must be within %v: %v", dir, path)
+	}
+	return path, nil
+}
+
+// Writes audit records to the plugin logger
+type logAuditSink struct{}
+
+func (logAuditSink) write(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	backend.Logger.Info("audit", "record", string(line))
+	return nil
+}
+
+// Appends audit records to a JSON lines file.  Once the file would grow past maxBytes, it's rotated:
+// path becomes path.1, path.1 becomes path.2, and so on, keeping maxFiles (at least 1) of them.  The file is opened
+// for each record, since instances of the data source (i.e. before and after its settings change) may
+// share it.
+type fileAuditSink struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+}
+
+// Serializes writes to audit files across all instances
+var auditFileMu sync.Mutex
+
+func (s *fileAuditSink) write(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	auditFileMu.Lock()
+	defer auditFileMu.Unlock()
+	if info, err := os.Stat(s.path); err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit file: %v", err.Error())
+		}
+	}
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %v", err.Error())
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit file: %v", err.Error())
+	}
+	return nil
+}
+
+// Rotate the files.  Only rotated files are ever removed, never the current one.
+func (s *fileAuditSink) rotate() error {
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+// Record the execution of a query, if there's an audit log.  Failing to write the record doesn't fail
+// the query, but is logged as an error.
+func (d *Datasource) auditQuery(pCtx backend.PluginContext, dataQuery backend.DataQuery, response backend.DataResponse, startTime time.Time) {
+	if d.audit == nil {
+		return
+	}
+	record := newAuditRecord(pCtx, dataQuery, response, startTime, d.Settings.AuditHashQuery)
+	if err := d.audit.write(record); err != nil {
+		backend.Logger.Error("failed to write audit record", "err", err, "refId", dataQuery.RefID)
+	}
+}
+
+func newAuditRecord(pCtx backend.PluginContext, dataQuery backend.DataQuery, response backend.DataResponse, startTime time.Time, hashQuery bool) *auditRecord {
+	var criblQuery models.CriblQuery
+	_ = json.Unmarshal(dataQuery.JSON, &criblQuery) // if it's invalid, the response says so
+	record := &auditRecord{
+		Time:          startTime.UTC(),
+		OrgID:         pCtx.OrgID,
+		RefID:         dataQuery.RefID,
+		QueryType:     criblQuery.Type,
+		SavedSearchId: criblQuery.SavedSearchId,
+		From:          dataQuery.TimeRange.From.UTC(),
+		To:            dataQuery.TimeRange.To.UTC(),
+		JobId:         criblQuery.JobId,
+		Status:        "ok",
+		DurationMs:    time.Since(startTime).Milliseconds(),
+	}
+	if pCtx.User != nil {
+		record.User = pCtx.User.Login
+	}
+	if pCtx.DataSourceInstanceSettings != nil {
+		record.DatasourceUID = pCtx.DataSourceInstanceSettings.UID
+	}
+	if response.Error != nil {
+		record.Status = "error"
+		record.Error = response.Error.Error()
+	}
+
+	// The frame says what was actually run (less the breadcrumb), and which job produced the results
+	query := criblQuery.Query
+	if len(response.Frames) > 0 {
+		frame := response.Frames[0]
+		record.EventCount = frame.Rows()
+		if frame.Meta != nil {
+			if len(frame.Meta.ExecutedQueryString) > 0 {
+				query = frame.Meta.ExecutedQueryString
+			}
+			if meta := criblFrameMetaOf(frame); meta != nil && len(meta.JobId) > 0 {
+				record.JobId = meta.JobId
+			}
+		}
+	}
+	if hashQuery && len(query) > 0 {
+		hash := sha256.Sum256([]byte(query))
+		record.QueryHash = hex.EncodeToString(hash[:])
+	} else {
+		record.Query = query
+	}
+	return record
+}
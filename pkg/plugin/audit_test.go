@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func readAuditFile(t *testing.T, path string) []auditRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditQuery(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"isFinished":true,"totalEventCount":2,"job":{"id":"j1","status":"completed"}}` + "\n" + `{"n":1}` + "\n" + `{"n":2}`))
+	})
+	dir := t.TempDir()
+	t.Setenv(AUDIT_DIR_ENV, dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	ds.Settings.AuditSink = AUDIT_SINK_FILE
+	ds.Settings.AuditFilePath = "audit.jsonl"
+	var err error
+	ds.audit, err = newAuditSink(ds.Settings)
+	assert.Nil(t, err)
+
+	timeRange := backend.TimeRange{From: time.Unix(1728744600, 0), To: time.Unix(1728748200, 0)}
+	run := func() {
+		_, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				OrgID:                      1,
+				User:                       &backend.User{Login: "bob"},
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "cribl1"},
+			},
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`)},
+				{RefID: "B", TimeRange: timeRange, JSON: []byte(`{"type":"saved","savedSearchId":"bogus","savedSearchMode":"bogus"}`)},
+			},
+		})
+		assert.Nil(t, err)
+	}
+	run()
+
+	records := readAuditFile(t, path)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "bob", records[0].User)
+	assert.Equal(t, int64(1), records[0].OrgID)
+	assert.Equal(t, "cribl1", records[0].DatasourceUID)
+	assert.Equal(t, "adhoc", records[0].QueryType)
+	assert.Equal(t, `dataset="foo"`, records[0].Query)
+	assert.Equal(t, "j1", records[0].JobId)
+	assert.Equal(t, "ok", records[0].Status)
+	assert.Equal(t, 2, records[0].EventCount)
+	assert.Equal(t, timeRange.From.UTC(), records[0].From)
+	assert.Equal(t, "saved", records[1].QueryType)
+	assert.Equal(t, "bogus", records[1].SavedSearchId)
+	assert.Equal(t, "error", records[1].Status)
+	assert.NotEmpty(t, records[1].Error)
+
+	// The query text can be hashed rather than stored
+	ds.Settings.AuditHashQuery = true
+	run()
+	records = readAuditFile(t, path)
+	assert.Len(t, records, 4)
+	assert.Empty(t, records[2].Query)
+	assert.Len(t, records[2].QueryHash, 64)
+}
+
+func TestAuditQueryCacheHit(t *testing.T) {
+	requests := 0
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"isFinished":true,"totalEventCount":1,"job":{"id":"j1","status":"completed"}}` + "\n" + `{"n":1}`))
+	})
+	ttlSec := 60.0
+	ds.Settings.CacheTtlSec = &ttlSec
+	ds.cache = newResultCache(ds.Settings)
+	dir := t.TempDir()
+	t.Setenv(AUDIT_DIR_ENV, dir)
+	ds.Settings.AuditSink = AUDIT_SINK_FILE
+	ds.Settings.AuditFilePath = "audit.jsonl"
+	var err error
+	ds.audit, err = newAuditSink(ds.Settings)
+	assert.Nil(t, err)
+
+	timeRange := backend.TimeRange{From: time.Unix(1728744600, 0), To: time.Unix(1728748200, 0)}
+	for i := 0; i < 2; i++ {
+		_, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`)}},
+		})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, requests, "the second query was served from the cache")
+
+	records := readAuditFile(t, filepath.Join(dir, "audit.jsonl"))
+	assert.Len(t, records, 2)
+	assert.Equal(t, "j1", records[1].JobId, "the job is taken from the cached frame's meta")
+	assert.Equal(t, `dataset="foo"`, records[1].Query)
+}
+
+func TestFileAuditSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(AUDIT_DIR_ENV, dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	maxMb := 0.0005 // ~500 bytes, a few records
+	maxFiles := 2
+	sink, err := newAuditSink(&models.PluginSettings{AuditSink: AUDIT_SINK_FILE, AuditFilePath: path, AuditFileMaxMb: &maxMb, AuditFileMaxFiles: &maxFiles})
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, sink.write(&auditRecord{QueryType: "adhoc", Query: strings.Repeat("x", 100), Status: "ok"}))
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		assert.Nil(t, err, name)
+		assert.LessOrEqual(t, info.Size(), int64(maxMb*(1<<20)), name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only maxFiles rotated files are kept")
+}
+
+func TestNewAuditSink(t *testing.T) {
+	sink, err := newAuditSink(&models.PluginSettings{})
+	assert.Nil(t, err)
+	assert.Nil(t, sink)
+	_, err = newAuditSink(&models.PluginSettings{AuditSink: AUDIT_SINK_FILE})
+	assert.NotNil(t, err, "a file sink needs a path")
+	_, err = newAuditSink(&models.PluginSettings{AuditSink: "bogus"})
+	assert.NotNil(t, err)
+
+	_, err = newAuditSink(&models.PluginSettings{AuditSink: AUDIT_SINK_FILE, AuditFilePath: "audit.jsonl"})
+	assert.NotNil(t, err, "a file sink needs the audit directory to be set")
+	dir := t.TempDir()
+	t.Setenv(AUDIT_DIR_ENV, dir)
+	for _, path := range []string{"../audit.jsonl", "/etc/passwd", dir, "logs/../../audit.jsonl"} {
+		_, err = newAuditSink(&models.PluginSettings{AuditSink: AUDIT_SINK_FILE, AuditFilePath: path})
+		assert.NotNil(t, err, "%v is outside the audit directory", path)
+	}
+	sink, err = newAuditSink(&models.PluginSettings{AuditSink: AUDIT_SINK_FILE, AuditFilePath: filepath.Join(dir, "logs", "audit.jsonl")})
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "logs", "audit.jsonl"), sink.(*fileAuditSink).path)
+
+	for _, maxFiles := range []int{0, -1} {
+		_, err = newAuditSink(&models.PluginSettings{AuditSink: AUDIT_SINK_FILE, AuditFilePath: "audit.jsonl", AuditFileMaxFiles: &maxFiles})
+		assert.NotNil(t, err, "maxFiles %d would remove the current file", maxFiles)
+	}
+}
@@ -65,15 +65,15 @@ func RefreshTokenViaOAuth(criblOrgBaseUrl string, clientId string, clientSecret
 
 	res, err := httpClient.Do(req)
 	if err != nil {
-		return &BearerToken{}, fmt.Errorf("auth http error: %v", err.Error())
+		return &BearerToken{}, badGatewayError(fmt.Errorf("auth http error: %v", err.Error()))
 	}
 	defer res.Body.Close()
 	responseBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		return &BearerToken{}, fmt.Errorf("auth error, reading body: %v", err.Error())
+		return &BearerToken{}, badGatewayError(fmt.Errorf("auth error, reading body: %v", err.Error()))
 	}
 	if res.StatusCode != http.StatusOK {
-		return &BearerToken{}, fmt.Errorf("auth error, status=%v, body=%v", res.StatusCode, string(responseBody[:]))
+		return &BearerToken{}, authStatusError(res.StatusCode, fmt.Errorf("auth error, status=%v, body=%v", res.StatusCode, string(responseBody[:])))
 	}
 
 	var oauthResponse struct {
@@ -81,7 +81,7 @@ func RefreshTokenViaOAuth(criblOrgBaseUrl string, clientId string, clientSecret
 		ExpiresIn   int64  `json:"expires_in"`
 	}
 	if err = json.Unmarshal(responseBody, &oauthResponse); err != nil {
-		return &BearerToken{}, fmt.Errorf("auth error, decoding body: %v", err.Error())
+		return &BearerToken{}, badGatewayError(fmt.Errorf("auth error, decoding body: %v", err.Error()))
 	}
 	return &BearerToken{
 		Token:     oauthResponse.AccessToken,
@@ -107,27 +107,27 @@ func RefreshTokenViaLocalAPI(apiBaseUrl string, username string, password string
 
 	res, err := httpClient.Do(req)
 	if err != nil {
-		return &BearerToken{}, fmt.Errorf("login http error: %v", err.Error())
+		return &BearerToken{}, badGatewayError(fmt.Errorf("login http error: %v", err.Error()))
 	}
 	defer res.Body.Close()
 	responseBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		return &BearerToken{}, fmt.Errorf("login error, reading body: %v", err.Error())
+		return &BearerToken{}, badGatewayError(fmt.Errorf("login error, reading body: %v", err.Error()))
 	}
 	if res.StatusCode != http.StatusOK {
-		return &BearerToken{}, fmt.Errorf("login error, status=%v, body=%v", res.StatusCode, string(responseBody[:]))
+		return &BearerToken{}, authStatusError(res.StatusCode, fmt.Errorf("login error, status=%v, body=%v", res.StatusCode, string(responseBody[:])))
 	}
 
 	var localLoginResponse struct {
 		Token string `json:"token"`
 	}
 	if err = json.Unmarshal(responseBody, &localLoginResponse); err != nil {
-		return &BearerToken{}, fmt.Errorf("login error, decoding body: %v", err.Error())
+		return &BearerToken{}, badGatewayError(fmt.Errorf("login error, decoding body: %v", err.Error()))
 	}
 
 	exp, err := parseExpFromJWT(localLoginResponse.Token)
 	if err != nil {
-		return &BearerToken{}, fmt.Errorf("login error, failed to parse JWT: %v", err.Error())
+		return &BearerToken{}, badGatewayError(fmt.Errorf("login error, failed to parse JWT: %v", err.Error()))
 	}
 	return &BearerToken{
 		Token:     localLoginResponse.Token,
@@ -135,6 +135,15 @@ func RefreshTokenViaLocalAPI(apiBaseUrl string, username string, password string
 	}, nil
 }
 
+// Classify a failed token request.  Unless the auth provider is down or throttling us, the credentials
+// were rejected.
+func authStatusError(statusCode int, err error) error {
+	if statusCode >= 500 || statusCode == http.StatusTooManyRequests {
+		return httpStatusError(statusCode, err)
+	}
+	return unauthorizedError(err)
+}
+
 // Parse the "exp" (expiration time) from a JWT and return it as epoch milliseconds
 func parseExpFromJWT(jwtString string) (int64, error) {
 	token, _, err := new(jwt.Parser).ParseUnverified(jwtString, jwt.MapClaims{})
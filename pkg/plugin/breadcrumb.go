@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Headers Grafana forwards with a query, identifying the dashboard panel it came from
+const DASHBOARD_UID_HEADER = "X-Dashboard-Uid"
+const PANEL_ID_HEADER = "X-Panel-Id"
+
+// Appended to a query (as a comment) to identify it in the search job history: where in Grafana it
+// came from, and any job tags.  Fields that aren't known are left out.
+type breadcrumb struct {
+	OrgID        int64
+	DashboardUID string
+	PanelID      string
+	RefID        string
+	User         string // login of the Grafana user, unless the data source hides it
+	Tags         []string
+}
+
+// The comment appended to the query, i.e. "// Grafana plugin org=1 dashboard=abc panel=2 refId=A user=bob"
+func (b *breadcrumb) String() string {
+	if b == nil {
+		return GRAFANA_BREADCRUMB
+	}
+	var fields []string
+	add := func(name string, value string) {
+		if tags := sanitizeJobTags([]string{value}); len(tags) > 0 {
+			fields = append(fields, name+"="+tags[0])
+		}
+	}
+	if b.OrgID > 0 {
+		add("org", strconv.FormatInt(b.OrgID, 10))
+	}
+	add("dashboard", b.DashboardUID)
+	add("panel", b.PanelID)
+	add("refId", b.RefID)
+	add("user", b.User)
+	if tags := sanitizeJobTags(b.Tags); len(tags) > 0 {
+		fields = append(fields, "tags="+strings.Join(tags, ","))
+	}
+	return strings.Join(append([]string{GRAFANA_BREADCRUMB}, fields...), " ")
+}
+
+type dashboardContextKey struct{}
+
+type dashboardPanel struct {
+	uid     string
+	panelId string
+}
+
+// Remember the dashboard & panel a request came from, for the breadcrumbs of its queries
+func withDashboardPanel(ctx context.Context, req *backend.QueryDataRequest) context.Context {
+	return context.WithValue(ctx, dashboardContextKey{}, dashboardPanel{req.GetHTTPHeader(DASHBOARD_UID_HEADER), req.GetHTTPHeader(PANEL_ID_HEADER)})
+}
+
+// The breadcrumb for a query, per the data source's privacy settings
+func (d *Datasource) newBreadcrumb(ctx context.Context, pCtx backend.PluginContext, refId string, tags []string) *breadcrumb {
+	crumb := &breadcrumb{OrgID: pCtx.OrgID, RefID: refId, Tags: tags}
+	if panel, ok := ctx.Value(dashboardContextKey{}).(dashboardPanel); ok {
+		crumb.DashboardUID = panel.uid
+		crumb.PanelID = panel.panelId
+	}
+	if pCtx.User != nil && !d.Settings.HideUserInBreadcrumb {
+		crumb.User = pCtx.User.Login
+	}
+	return crumb
+}
+
+// Cut the breadcrumb off a prepared query, leaving what identifies its results
+func stripBreadcrumb(preparedQuery string) string {
+	if i := strings.LastIndex(preparedQuery, "\n"+GRAFANA_BREADCRUMB); i >= 0 {
+		return preparedQuery[:i]
+	}
+	return preparedQuery
+}
@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreadcrumbString(t *testing.T) {
+	var crumb *breadcrumb
+	assert.Equal(t, "// Grafana plugin", crumb.String())
+	crumb = &breadcrumb{OrgID: 1, DashboardUID: "abc123", PanelID: "2", RefID: "A", User: "bob@example.com", Tags: []string{"nightly"}}
+	assert.Equal(t, "// Grafana plugin org=1 dashboard=abc123 panel=2 refId=A user=bob@example.com tags=nightly", crumb.String())
+	crumb = &breadcrumb{RefID: "B", User: "bob\n| where evil"}
+	assert.Equal(t, "// Grafana plugin refId=B user=bob_where_evil", crumb.String(), "fields can't break out of the comment")
+}
+
+func TestQueryBreadcrumb(t *testing.T) {
+	var queries []string
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		w.Write([]byte(`{"isFinished":true,"totalEventCount":0,"job":{"id":"j1","status":"completed"}}`))
+	})
+	run := func() {
+		req := &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{OrgID: 1, User: &backend.User{Login: "bob"}},
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()},
+				JSON:      []byte(`{"type":"adhoc","query":"dataset=\"foo\"","jobTags":["nightly"]}`),
+			}},
+		}
+		req.SetHTTPHeader(DASHBOARD_UID_HEADER, "abc123")
+		req.SetHTTPHeader(PANEL_ID_HEADER, "2")
+		_, err := ds.QueryData(context.Background(), req)
+		assert.Nil(t, err)
+	}
+
+	run()
+	assert.Equal(t, "dataset=\"foo\"\n// Grafana plugin org=1 dashboard=abc123 panel=2 refId=A user=bob tags=nightly", queries[0])
+
+	// For privacy, the user can be left out
+	ds.Settings.HideUserInBreadcrumb = true
+	run()
+	assert.False(t, strings.Contains(queries[1], "user="))
+	assert.Contains(t, queries[1], "dashboard=abc123")
+}
+
+func TestExecutedQueryOmitsBreadcrumb(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"isFinished":true,"totalEventCount":0,"job":{"id":"j1","status":"completed"}}`))
+	})
+	ttl := 60.0
+	ds.Settings.CacheTtlSec = &ttl
+	ds.cache = newResultCache(ds.Settings)
+	timeRange := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+	for _, login := range []string{"alice", "bob"} {
+		// Bob gets Alice's cached results, which mustn't say she ran the query
+		res := ds.query(context.Background(), backend.PluginContext{OrgID: 1, User: &backend.User{Login: login}}, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`)})
+		assert.Nil(t, res.Error)
+		assert.Equal(t, `dataset="foo"`, res.Frames[0].Meta.ExecutedQueryString, login)
+	}
+}
+
+func TestQueryKeyIgnoresBreadcrumb(t *testing.T) {
+	params := func(crumb *breadcrumb) map[string][]string {
+		return map[string][]string{"query": {prepareQuery(`dataset="foo"`, crumb)}, "earliest": {"-1h"}}
+	}
+	alice := queryKey("https://example.cribl.cloud", params(&breadcrumb{User: "alice", PanelID: "1"}), &models.CriblQuery{}, nil, 0)
+	bob := queryKey("https://example.cribl.cloud", params(&breadcrumb{User: "bob", PanelID: "2"}), &models.CriblQuery{}, nil, 0)
+	assert.Equal(t, alice, bob, "the same query from a different user or panel shares results")
+}
@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const SEARCH_GROUP = "default_search" // the search group our queries run in
+const DEFAULT_CACHE_MAX_MB = 100
+const DEFAULT_CACHE_GRANULARITY = time.Minute
+
+// Expose counter metrics tracking result cache hits & misses, broken down by query type
+var cacheHitCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "grafana_plugin",
+		Name:      "cribl_search_cache_hits_total",
+		Help:      "Total number of queries answered from the result cache.",
+	},
+	[]string{"query_type"},
+)
+var cacheMissCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "grafana_plugin",
+		Name:      "cribl_search_cache_misses_total",
+		Help:      "Total number of cacheable queries not found in the result cache.",
+	},
+	[]string{"query_type"},
+)
+
+// In-process cache of query results, so repeated identical queries (i.e. a dashboard auto-refreshing
+// for many viewers) don't each run a Cribl job.  Entries expire after a TTL, and the least recently
+// used entries are evicted to keep the total size under a limit.  Frames are stored Arrow-encoded,
+// which gives us both an accurate size and an independent copy for each hit.
+type resultCache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	maxBytes    int
+	granularity time.Duration
+	size        int                      // total bytes of all entries
+	entries     map[string]*list.Element // of *cacheEntry
+	lru         *list.List               // most recently used at the front
+}
+
+type cacheEntry struct {
+	key       string
+	frames    [][]byte
+	size      int
+	expiresAt time.Time
+}
+
+// Create the result cache configured by the settings, or nil if caching is disabled (no TTL)
+func newResultCache(settings *models.PluginSettings) *resultCache {
+	if settings.CacheTtlSec == nil || *settings.CacheTtlSec <= 0 {
+		return nil
+	}
+	maxMb := float64(DEFAULT_CACHE_MAX_MB)
+	if settings.CacheMaxMb != nil && *settings.CacheMaxMb > 0 {
+		maxMb = *settings.CacheMaxMb
+	}
+	granularity := DEFAULT_CACHE_GRANULARITY
+	if settings.CacheGranularitySec != nil && *settings.CacheGranularitySec > 0 {
+		granularity = time.Duration(*settings.CacheGranularitySec * 1e9)
+	}
+	return &resultCache{
+		ttl:         time.Duration(*settings.CacheTtlSec * 1e9),
+		maxBytes:    int(maxMb * 1024 * 1024),
+		granularity: granularity,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+}
+
+// Build the cache key for a query, given the API params of its initial request
+func (c *resultCache) key(baseUrl string, queryParams url.Values, criblQuery *models.CriblQuery, timeFields map[string]bool) string {
+	return queryKey(baseUrl, queryParams, criblQuery, timeFields, c.granularity)
+}
+
+// Build a key identifying a query's results, given the API params of its initial request.  If a granularity
+// is given, absolute earliest/latest times are rounded down to it, so time ranges differing by less than that
+// (i.e. a "last 1 hour" dashboard refreshed a few seconds apart) share a key.  Paging params and the query's
+// breadcrumb don't matter, and the query options affecting how frames are built, or whether the query
+// succeeds (i.e. its timeout), are included.
+func queryKey(baseUrl string, queryParams url.Values, criblQuery *models.CriblQuery, timeFields map[string]bool, granularity time.Duration) string {
+	params := url.Values{}
+	for name, values := range queryParams {
+		if name == "offset" || name == "limit" {
+			continue
+		}
+		if (name == "earliest" || name == "latest") && granularity > 0 {
+			values = []string{roundCriblTime(queryParams.Get(name), granularity)}
+		}
+		if name == "query" {
+			// The same query from a different panel or user gets the same results
+			values = []string{stripBreadcrumb(queryParams.Get(name))}
+		}
+		params[name] = values
+	}
+	normalized, _ := json.Marshal(struct {
+		BaseUrl       string          `json:"baseUrl"`
+		SearchGroup   string          `json:"searchGroup"`
+		Params        string          `json:"params"` // sorted by name
+		TimeFields    map[string]bool `json:"timeFields"`
+		ChunkInterval string          `json:"chunkInterval"`
+		FillMode      string          `json:"fillMode"`
+		FillInterval  string          `json:"fillInterval"`
+		Incremental   bool            `json:"incremental"`
+
+		SavedSearchFreshness string   `json:"savedSearchFreshness"`
+		MaxAgeMinutes        float64  `json:"maxAgeMinutes"`
+		PartialResults       bool     `json:"partialResults"`
+		TimeoutSec           *float64 `json:"timeoutSec"`
+	}{baseUrl, SEARCH_GROUP, params.Encode(), timeFields, criblQuery.ChunkInterval, criblQuery.FillMode, criblQuery.FillInterval, criblQuery.Incremental,
+		criblQuery.SavedSearchFreshness, criblQuery.MaxAgeMinutes, criblQuery.PartialResults, criblQuery.TimeoutSec})
+	hash := sha256.Sum256(normalized)
+	return hex.EncodeToString(hash[:])
+}
+
+// Round an epoch seconds time down to the given granularity.  Relative times (i.e. "-1h") are left as is.
+func roundCriblTime(value string, granularity time.Duration) string {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	step := granularity.Seconds()
+	return strconv.FormatFloat(math.Floor(seconds/step)*step, 'f', -1, 64)
+}
+
+// Get the cached frames for a key, if present and not expired
+func (c *resultCache) get(key string, now time.Time) (data.Frames, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if now.After(entry.expiresAt) {
+		c.remove(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	frames, err := data.UnmarshalArrowFrames(entry.frames)
+	if err != nil {
+		backend.Logger.Warn("unable to decode cached frames", "err", err)
+		c.remove(element)
+		return nil, false
+	}
+	return frames, true
+}
+
+// Cache the frames for a key, evicting expired and then least recently used entries to make room.
+// Frames too big to ever fit aren't cached.
+func (c *resultCache) put(key string, frames data.Frames, now time.Time) {
+	encoded, err := frames.MarshalArrow()
+	if err != nil {
+		backend.Logger.Warn("unable to encode frames for caching", "err", err)
+		return
+	}
+	size := 0
+	for _, b := range encoded {
+		size += len(b)
+	}
+	if size > c.maxBytes {
+		backend.Logger.Debug("results too big to cache", "size", size, "maxBytes", c.maxBytes)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	for element := c.lru.Back(); element != nil; {
+		prev := element.Prev()
+		if now.After(element.Value.(*cacheEntry).expiresAt) {
+			c.remove(element)
+		}
+		element = prev
+	}
+	for c.size+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, frames: encoded, size: size, expiresAt: now.Add(c.ttl)})
+	c.size += size
+}
+
+// Remove an entry, the caller must hold the lock
+func (c *resultCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// Whether a response is complete & successful, and therefore safe to cache
+func isCacheableResponse(response backend.DataResponse) bool {
+	if response.Error != nil {
+		return false
+	}
+	for _, frame := range response.Frames {
+		if frame.Meta == nil {
+			continue
+		}
+		for _, notice := range frame.Meta.Notices {
+			if notice.Severity == data.NoticeSeverityWarning || notice.Severity == data.NoticeSeverityError {
+				return false // i.e. some chunks failed
+			}
+		}
+	}
+	return true
+}
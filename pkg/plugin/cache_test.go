@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCache(ttl time.Duration, maxBytes int) *resultCache {
+	ttlSec := ttl.Seconds()
+	cache := newResultCache(&models.PluginSettings{CacheTtlSec: &ttlSec})
+	cache.maxBytes = maxBytes
+	return cache
+}
+
+func TestNewResultCache(t *testing.T) {
+	assert.Nil(t, newResultCache(&models.PluginSettings{}), "disabled without a TTL")
+	ttl, granularity := 30.0, 10.0
+	cache := newResultCache(&models.PluginSettings{CacheTtlSec: &ttl, CacheGranularitySec: &granularity})
+	assert.Equal(t, 30*time.Second, cache.ttl)
+	assert.Equal(t, 10*time.Second, cache.granularity)
+	assert.Equal(t, DEFAULT_CACHE_MAX_MB*1024*1024, cache.maxBytes)
+}
+
+func TestResultCacheKey(t *testing.T) {
+	cache := newTestCache(time.Minute, 1024*1024)
+	query := &models.CriblQuery{Type: "adhoc"}
+	params := func(earliest, latest string, offset string) url.Values {
+		return url.Values{"query": {"dataset=\"foo\""}, "earliest": {earliest}, "latest": {latest}, "offset": {offset}}
+	}
+	key := cache.key("https://org.cribl.cloud", params("1728744793.123", "1728748393.456", "0"), query, nil)
+	assert.Equal(t, key, cache.key("https://org.cribl.cloud", params("1728744780", "1728748399", "100"), query, nil), "same minute, paging ignored")
+	assert.NotEqual(t, key, cache.key("https://org.cribl.cloud", params("1728744793.123", "1728748440", "0"), query, nil), "next minute")
+	assert.NotEqual(t, key, cache.key("https://other.cribl.cloud", params("1728744793.123", "1728748393.456", "0"), query, nil), "other org")
+	assert.NotEqual(t, key, cache.key("https://org.cribl.cloud", params("1728744793.123", "1728748393.456", "0"), &models.CriblQuery{Type: "adhoc", FillMode: "zero"}, nil), "frames are built differently")
+
+	// Options affecting whether the query succeeds, or which results it uses
+	timeoutSec := 5.0
+	for _, option := range []*models.CriblQuery{
+		{Type: "adhoc", SavedSearchFreshness: SAVED_SEARCH_FRESHNESS_CACHE_ONLY},
+		{Type: "adhoc", SavedSearchFreshness: SAVED_SEARCH_FRESHNESS_MAX_AGE, MaxAgeMinutes: 5},
+		{Type: "adhoc", PartialResults: true},
+		{Type: "adhoc", TimeoutSec: &timeoutSec},
+		{Type: "adhoc", Incremental: true},
+	} {
+		assert.NotEqual(t, key, cache.key("https://org.cribl.cloud", params("1728744793.123", "1728748393.456", "0"), option, nil), "%+v", option)
+	}
+
+	assert.Equal(t, "-1h", roundCriblTime("-1h", time.Minute))
+	assert.Equal(t, "1728744780", roundCriblTime("1728744793.123", time.Minute))
+}
+
+func TestResultCacheGetPut(t *testing.T) {
+	now := time.Now()
+	makeFrames := func(n int) data.Frames {
+		return data.Frames{data.NewFrame("results", data.NewField("n", nil, make([]float64, n)))}
+	}
+	encodedSize := func(frames data.Frames) int {
+		encoded, _ := frames.MarshalArrow()
+		return len(encoded[0])
+	}
+
+	cache := newTestCache(time.Minute, 2*encodedSize(makeFrames(100))+10)
+	cache.put("a", makeFrames(100), now)
+	frames, ok := cache.get("a", now)
+	assert.True(t, ok)
+	assert.Equal(t, 100, frames[0].Rows())
+	_, ok = cache.get("a", now.Add(2*time.Minute))
+	assert.False(t, ok, "expired")
+	assert.Equal(t, 0, cache.size)
+
+	// Least recently used entries are evicted to make room
+	cache.put("a", makeFrames(100), now)
+	cache.put("b", makeFrames(100), now)
+	cache.get("a", now)
+	cache.put("c", makeFrames(100), now)
+	_, ok = cache.get("b", now)
+	assert.False(t, ok, "evicted")
+	_, ok = cache.get("a", now)
+	assert.True(t, ok)
+	_, ok = cache.get("c", now)
+	assert.True(t, ok)
+
+	cache.put("huge", makeFrames(10000), now)
+	_, ok = cache.get("huge", now)
+	assert.False(t, ok, "too big to cache")
+}
+
+func TestQueryUsesResultCache(t *testing.T) {
+	var requests atomic.Int32
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"isFinished":true,"totalEventCount":1,"job":{"id":"j1","status":"completed"}}` + "\n" + `{"_time":1728744793,"n":1}`))
+	})
+	ds.cache = newTestCache(time.Minute, 1024*1024)
+
+	timeRange := backend.TimeRange{From: time.Unix(1728744000, 0), To: time.Unix(1728747600, 0)}
+	run := func(refId string, json string) backend.DataResponse {
+		return ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: refId, TimeRange: timeRange, JSON: []byte(json)})
+	}
+	res := run("A", `{"type":"adhoc","query":"dataset=\"foo\""}`)
+	assert.Nil(t, res.Error)
+	assert.Equal(t, int32(1), requests.Load())
+
+	res = run("B", `{"type":"adhoc","query":"dataset=\"foo\""}`)
+	assert.Nil(t, res.Error)
+	assert.Equal(t, int32(1), requests.Load(), "cache hit")
+	assert.Equal(t, "B", res.Frames[0].RefID)
+	assert.Equal(t, 1, res.Frames[0].Rows())
+
+	run("A", `{"type":"adhoc","query":"dataset=\"foo\"","bypassCache":true}`)
+	assert.Equal(t, int32(2), requests.Load(), "cache bypassed")
+
+	// The same query with a different timeout, or partial results, doesn't get the other's results
+	run("A", `{"type":"adhoc","query":"dataset=\"foo\"","timeoutSec":5}`)
+	assert.Equal(t, int32(3), requests.Load())
+	run("A", `{"type":"adhoc","query":"dataset=\"foo\"","partialResults":true}`)
+	assert.Equal(t, int32(4), requests.Load())
+}
@@ -0,0 +1,225 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const DEFAULT_MAX_CHUNK_JOBS = 4 // concurrent jobs per chunked query, unless configured otherwise
+const MAX_QUERY_CHUNKS = 1000    // guard against a tiny chunk interval over a huge time range
+
+// A slice of a query's time range, run as its own job
+type queryChunk struct {
+	From time.Time
+	To   time.Time
+}
+
+// Split a time range into consecutive chunks of the given interval.  The last chunk is cut short
+// at the end of the range.
+func splitTimeRange(timeRange backend.TimeRange, interval time.Duration) ([]queryChunk, error) {
+	if !timeRange.To.After(timeRange.From) {
+		return nil, fmt.Errorf("time range is empty, nothing to split")
+	}
+	if count := timeRange.To.Sub(timeRange.From) / interval; count >= MAX_QUERY_CHUNKS {
+		return nil, fmt.Errorf("chunk interval %v would split the time range into too many chunks (max %d)", interval, MAX_QUERY_CHUNKS)
+	}
+	var chunks []queryChunk
+	for from := timeRange.From; from.Before(timeRange.To); from = from.Add(interval) {
+		chunks = append(chunks, queryChunk{From: from, To: minTime(from.Add(interval), timeRange.To)})
+	}
+	return chunks, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// The max # of chunk jobs to run concurrently
+func maxChunkJobs(settings *models.PluginSettings) int {
+	if settings != nil && settings.MaxChunkJobs != nil && *settings.MaxChunkJobs > 0 {
+		return *settings.MaxChunkJobs
+	}
+	return DEFAULT_MAX_CHUNK_JOBS
+}
+
+// Run an ad-hoc query as one job per chunk of its time range, at most maxChunkJobs at a time, and add
+// the merged events to the builder in time order.  If only some chunks fail, the events of the rest
+// are still used and the failures are returned as a warning notice.  If every chunk fails, that's an
+// error.  Chunks always use absolute times, even if the query asked for a relative time range.
+func (d *Datasource) queryChunked(ctx context.Context, preparedQuery string, timeout time.Duration, chunkInterval time.Duration, timeRange backend.TimeRange, builder *frameBuilder, meta *CriblFrameMeta) ([]data.Notice, error) {
+	chunks, err := splitTimeRange(timeRange, chunkInterval)
+	if err != nil {
+		return nil, invalidQueryError(err)
+	}
+	backend.Logger.Debug("running chunked query", "chunks", len(chunks), "chunkInterval", chunkInterval)
+
+	results := make([][]map[string]interface{}, len(chunks))
+	errs := make([]error, len(chunks))
+	semaphore := make(chan struct{}, maxChunkJobs(d.Settings))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			results[i], errs[i] = d.runChunk(ctx, preparedQuery, timeout, chunk)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, queryCanceledError()
+	}
+
+	var failed []string
+	firstFailed := -1
+	for i, err := range errs {
+		if err != nil {
+			if firstFailed < 0 {
+				firstFailed = i
+			}
+			backend.Logger.Debug("chunk failed", "from", chunks[i].From, "to", chunks[i].To, "err", err)
+			failed = append(failed, fmt.Sprintf("%v to %v: %v", chunks[i].From.UTC().Format(time.RFC3339), chunks[i].To.UTC().Format(time.RFC3339), err.Error()))
+		}
+	}
+	meta.Chunks = len(chunks)
+	meta.FailedChunks = len(failed)
+	if len(failed) == len(chunks) {
+		chunk := chunks[firstFailed]
+		return nil, fmt.Errorf("All %d chunks of the query failed, i.e. %v to %v: %w", len(chunks), chunk.From.UTC().Format(time.RFC3339), chunk.To.UTC().Format(time.RFC3339), errs[firstFailed])
+	}
+
+	var notices []data.Notice
+	events, truncated := mergeChunkEvents(results, builder.timeFields)
+	if truncated {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("The chunks produced more than %d events, only the most recent %d are shown.", MAX_RESULTS, MAX_RESULTS),
+		})
+	}
+	if len(failed) > 0 {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d of %d chunks failed, results are incomplete.  First failure: %v", len(failed), len(chunks), failed[0]),
+		})
+	}
+	for _, event := range events {
+		builder.addEvent(event)
+		resultsCounter.WithLabelValues("adhoc").Inc()
+	}
+	return notices, nil
+}
+
+// Run the query over a single chunk, waiting for its job to finish, and page through its events
+// (up to MAX_RESULTS).  The query's timeout (if any) applies to each chunk.
+func (d *Datasource) runChunk(ctx context.Context, preparedQuery string, timeout time.Duration, chunk queryChunk) ([]map[string]interface{}, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	queryParams := url.Values{}
+	queryParams.Set("query", preparedQuery)
+	queryParams.Set("earliest", formatCriblTime(chunk.From))
+	queryParams.Set("latest", formatCriblTime(chunk.To))
+	queryParams.Set("limit", strconv.Itoa(QUERY_PAGE_SIZE))
+	result, err := d.SearchAPI.runQueryToCompletion(ctx, &queryParams)
+	if err != nil {
+		return nil, err
+	}
+	events := result.Events
+	jobId := result.Header["job"].(map[string]interface{})["id"].(string)
+	totalEventCount := min(totalEventCountOf(result.Header), MAX_RESULTS)
+
+	// The job is finished, so the remaining pages are immediately available
+	if len(events) > 0 && len(events) < totalEventCount {
+		rest, err := d.SearchAPI.FetchPages(ctx, jobId, len(events), totalEventCount)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, rest...)
+	}
+	return events, nil
+}
+
+// Merge the events of each chunk (in chunk order), sorted by their time fields (see eventTime).  Events
+// without a usable time go last.  At most MAX_RESULTS events are kept, preferring the most recent, in
+// which case truncated is true.
+func mergeChunkEvents(results [][]map[string]interface{}, timeFields map[string]bool) (events []map[string]interface{}, truncated bool) {
+	type timedEvent struct {
+		t     time.Time
+		ok    bool
+		event map[string]interface{}
+	}
+	names := orderedTimeFields(timeFields)
+	var merged []timedEvent
+	for _, chunkEvents := range results {
+		for _, event := range chunkEvents {
+			ok, t := eventTime(event, names)
+			merged = append(merged, timedEvent{t, ok, event})
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].ok && merged[j].ok {
+			return merged[i].t.Before(merged[j].t)
+		}
+		return merged[i].ok && !merged[j].ok
+	})
+
+	// Drop the oldest timed events first
+	dropped := max(len(merged)-MAX_RESULTS, 0)
+	events = make([]map[string]interface{}, 0, len(merged)-dropped)
+	for i, e := range merged {
+		if i < dropped && e.ok {
+			continue
+		}
+		if !e.ok && len(events) >= MAX_RESULTS {
+			break
+		}
+		events = append(events, e.event)
+	}
+	return events, dropped > 0
+}
+
+// The names of a query's time fields, in the order eventTime tries them: "_time" (if it's one of them),
+// then the rest by name.  With no time fields, just "_time".
+func orderedTimeFields(timeFields map[string]bool) []string {
+	var names []string
+	for name := range timeFields {
+		if name != CRIBL_TIME_FIELD {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if timeFields[CRIBL_TIME_FIELD] || len(timeFields) == 0 {
+		names = append([]string{CRIBL_TIME_FIELD}, names...)
+	}
+	return names
+}
+
+// The time of an event, from the first of the named time fields holding a usable time
+func eventTime(event map[string]interface{}, timeFieldNames []string) (bool, time.Time) {
+	for _, name := range timeFieldNames {
+		if ok, t := criblTimeToGrafanaTime(event[name]); ok {
+			return true, t
+		}
+	}
+	return false, time.Time{}
+}
@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitTimeRange(t *testing.T) {
+	base := time.Unix(1728744600, 0).UTC()
+	chunks, err := splitTimeRange(backend.TimeRange{From: base, To: base.Add(50 * time.Hour)}, 24*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []queryChunk{
+		{From: base, To: base.Add(24 * time.Hour)},
+		{From: base.Add(24 * time.Hour), To: base.Add(48 * time.Hour)},
+		{From: base.Add(48 * time.Hour), To: base.Add(50 * time.Hour)},
+	}, chunks)
+
+	_, err = splitTimeRange(backend.TimeRange{From: base, To: base.Add(30 * 24 * time.Hour)}, time.Minute)
+	assert.NotNil(t, err, "too many chunks")
+	_, err = splitTimeRange(backend.TimeRange{From: base, To: base}, time.Hour)
+	assert.NotNil(t, err, "empty time range")
+}
+
+func TestMaxChunkJobs(t *testing.T) {
+	assert.Equal(t, DEFAULT_MAX_CHUNK_JOBS, maxChunkJobs(&models.PluginSettings{}))
+	two := 2
+	assert.Equal(t, 2, maxChunkJobs(&models.PluginSettings{MaxChunkJobs: &two}))
+}
+
+func TestMergeChunkEvents(t *testing.T) {
+	events, truncated := mergeChunkEvents([][]map[string]interface{}{
+		{{"_time": float64(1728744795), "id": "b"}, {"id": "no time"}, {"_time": float64(1728744794), "id": "a"}},
+		{{"_time": float64(1728744796), "id": "c"}},
+	}, nil)
+	assert.False(t, truncated)
+	var ids []interface{}
+	for _, event := range events {
+		ids = append(ids, event["id"])
+	}
+	assert.Equal(t, []interface{}{"a", "b", "c", "no time"}, ids)
+
+	var many []map[string]interface{}
+	for i := 0; i < MAX_RESULTS+5; i++ {
+		many = append(many, map[string]interface{}{"_time": float64(1728744000 + i)})
+	}
+	events, truncated = mergeChunkEvents([][]map[string]interface{}{many}, nil)
+	assert.True(t, truncated)
+	assert.Len(t, events, MAX_RESULTS)
+	assert.Equal(t, float64(1728744005), events[0]["_time"], "the oldest events are dropped")
+
+	// Sorted by the query's own time field
+	events, _ = mergeChunkEvents([][]map[string]interface{}{
+		{{"ts": "2024-10-12T14:53:15Z", "_time": float64(1), "id": "b"}, {"id": "no time"}},
+		{{"ts": "2024-10-12T14:53:14Z", "_time": float64(2), "id": "a"}},
+	}, map[string]bool{"ts": true})
+	ids = nil
+	for _, event := range events {
+		ids = append(ids, event["id"])
+	}
+	assert.Equal(t, []interface{}{"a", "b", "no time"}, ids)
+}
+
+func TestOrderedTimeFields(t *testing.T) {
+	assert.Equal(t, []string{"_time"}, orderedTimeFields(nil))
+	assert.Equal(t, []string{"_time", "a", "b"}, orderedTimeFields(map[string]bool{"b": true, "_time": true, "a": true}))
+	assert.Equal(t, []string{"ts"}, orderedTimeFields(map[string]bool{"ts": true}))
+}
+
+func TestQueryChunked(t *testing.T) {
+	base := time.Unix(1728744600, 0).UTC()
+	failingEarliest := formatCriblTime(base.Add(time.Hour))
+
+	var mu sync.Mutex
+	var earliests []string
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		mu.Lock()
+		earliests = append(earliests, params.Get("earliest"))
+		mu.Unlock()
+		if params.Get("earliest") == failingEarliest {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message":"boom"}`))
+			return
+		}
+		earliest, _ := strconv.ParseFloat(params.Get("earliest"), 64)
+		w.Write([]byte(`{"isFinished":true,"totalEventCount":1,"job":{"id":"j` + params.Get("earliest") + `","status":"completed"}}` + "\n" +
+			`{"_time":` + strconv.FormatFloat(earliest, 'f', -1, 64) + `}`))
+	})
+	one := 1
+	ds.Settings.MaxChunkJobs = &one
+
+	frame := data.NewFrame("results")
+	meta := &CriblFrameMeta{}
+	builder := newFrameBuilder(frame, map[string]bool{CRIBL_TIME_FIELD: true})
+	timeRange := backend.TimeRange{From: base, To: base.Add(3 * time.Hour)}
+	notices, err := ds.queryChunked(context.Background(), "dataset=\"foo\"", 0, time.Hour, timeRange, builder, meta)
+	assert.Nil(t, err)
+	builder.finish()
+	assert.Len(t, earliests, 3)
+	assert.Equal(t, 3, meta.Chunks)
+	assert.Equal(t, 1, meta.FailedChunks)
+	assert.Equal(t, 2, frame.Rows())
+	assert.Equal(t, base, frame.Fields[0].At(0))
+	assert.Equal(t, base.Add(2*time.Hour), frame.Fields[0].At(1))
+	if assert.Len(t, notices, 1) {
+		assert.True(t, strings.HasPrefix(notices[0].Text, "1 of 3 chunks failed"))
+	}
+
+	// When every chunk fails, it's an error
+	failingEarliest = formatCriblTime(base)
+	_, err = ds.queryChunked(context.Background(), "dataset=\"foo\"", 0, time.Hour, backend.TimeRange{From: base, To: base.Add(time.Hour)}, newFrameBuilder(data.NewFrame("results"), nil), &CriblFrameMeta{})
+	assert.NotNil(t, err)
+}
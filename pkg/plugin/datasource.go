@@ -7,7 +7,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/criblcloud/search-datasource/pkg/models"
@@ -21,16 +25,40 @@ import (
 
 // Ensure it actually implements the interfaces we need it to
 var (
-	_ backend.QueryDataHandler    = (*Datasource)(nil)
-	_ backend.CheckHealthHandler  = (*Datasource)(nil)
-	_ backend.CallResourceHandler = (*Datasource)(nil)
+	_ backend.QueryDataHandler      = (*Datasource)(nil)
+	_ backend.CheckHealthHandler    = (*Datasource)(nil)
+	_ backend.CallResourceHandler   = (*Datasource)(nil)
+	_ backend.StreamHandler         = (*Datasource)(nil)
+	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
 const MAX_RESULTS = 10000 // same as what the actual Cribl UI imposes
 const QUERY_PAGE_SIZE = 1000
+const MAX_PAGE_FETCHES = 4 // # of result pages fetched at once
 const CRIBL_TIME_FIELD = "_time"
 const MAX_BACKOFF_DURATION = 2 * time.Second
 const GRAFANA_TIME_FIELD_NAME = "Time"
+const TAG_SAMPLE_SIZE = 1000 // # of events/values sampled to populate ad hoc filter keys & values
+const DEFAULT_TAG_QUERY = `dataset="*"`
+
+// Appended to queries, identifying them in the search job history
+const GRAFANA_BREADCRUMB = "// Grafana plugin"
+const MAX_JOB_TAGS = 10
+
+// How saved searches are run, see models.CriblQuery.SavedSearchMode
+const (
+	SAVED_SEARCH_MODE_CACHED          = "cached"         // use the cached results of the scheduled search
+	SAVED_SEARCH_MODE_SAVED_RANGE     = "savedRange"     // re-run the saved search with its own time range
+	SAVED_SEARCH_MODE_DASHBOARD_RANGE = "dashboardRange" // re-run the saved search with the dashboard's time range
+)
+
+// Freshness policies for cached saved search results, see models.CriblQuery.SavedSearchFreshness
+const (
+	SAVED_SEARCH_FRESHNESS_DEFAULT    = ""          // use cached results if any, otherwise run the search
+	SAVED_SEARCH_FRESHNESS_MAX_AGE    = "maxAge"    // re-run if the cached results are older than MaxAgeMinutes
+	SAVED_SEARCH_FRESHNESS_CACHE_ONLY = "cacheOnly" // fail if there are no cached results, never run the search
+	SAVED_SEARCH_FRESHNESS_ALWAYS     = "always"    // always re-run, never use cached results
+)
 
 // Expose a counter metric tracking the # of queries, broken down by type (adhoc vs. savedSearchId)
 var queryCounter = promauto.NewCounterVec(
@@ -56,8 +84,22 @@ type Datasource struct {
 	ResourceHandler backend.CallResourceHandler
 	Settings        *models.PluginSettings
 	SearchAPI       *SearchAPI
+	cache           *resultCache     // nil when caching is disabled
+	flights         queryFlights     // identical queries currently running
+	incremental     incrementalStore // previous results of incremental queries
+	audit           auditSink        // nil when there's no audit log
+	allowedDatasets []*regexp.Regexp // compiled from Settings.AllowedDatasets, nil when any dataset is allowed
+
+	lifetime context.Context // canceled when the instance is disposed, stopping any polling
+	stop     context.CancelFunc
 }
 
+// Live datasource instances, so they can be disposed when the plugin process shuts down
+var instances = struct {
+	sync.Mutex
+	all map[*Datasource]bool
+}{all: map[*Datasource]bool{}}
+
 // NewDatasource creates a new datasource instance.
 func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 	ps, err := models.LoadPluginSettings(settings)
@@ -67,14 +109,69 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 	ds := &Datasource{}
 	ds.Settings = ps
 	ds.SearchAPI = NewSearchAPI(ps)
+	ds.cache = newResultCache(ps)
+	ds.allowedDatasets = compileAllowedDatasets(ps.AllowedDatasets)
+	if ds.audit, err = newAuditSink(ps); err != nil {
+		return nil, err
+	}
+	ds.lifetime, ds.stop = context.WithCancel(context.Background())
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/savedSearchIds", ds.handleSavedSearchIds)
+	mux.HandleFunc("/tagKeys", ds.handleTagKeys)
+	mux.HandleFunc("/tagValues", ds.handleTagValues)
+	mux.HandleFunc("/streamPath", ds.handleStreamPath)
 	ds.ResourceHandler = httpadapter.New(mux)
 
+	instances.Lock()
+	instances.all[ds] = true
+	instances.Unlock()
 	return ds, nil
 }
 
+// Dispose is called when the instance is no longer needed, i.e. its settings changed and a new instance
+// replaces it.  Polling stops, and any jobs the instance started which are still running are canceled,
+// rather than left to run to completion on Cribl.
+func (d *Datasource) Dispose() {
+	instances.Lock()
+	delete(instances.all, d)
+	instances.Unlock()
+
+	if d.stop != nil {
+		d.stop()
+	}
+	if d.SearchAPI != nil {
+		backend.Logger.Info("disposing datasource instance", "activeJobs", len(d.SearchAPI.ActiveJobIds()))
+		d.SearchAPI.CancelActiveJobs()
+	}
+}
+
+// Dispose every live instance, i.e. when the plugin process is shutting down
+func DisposeAll() {
+	instances.Lock()
+	all := make([]*Datasource, 0, len(instances.all))
+	for ds := range instances.all {
+		all = append(all, ds)
+	}
+	instances.Unlock()
+	for _, ds := range all {
+		ds.Dispose()
+	}
+}
+
+// Derive a context which is also canceled when the instance is disposed
+func (d *Datasource) withLifetime(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if d.lifetime == nil {
+		return ctx, cancel
+	}
+	stopAfter := context.AfterFunc(d.lifetime, cancel)
+	return ctx, func() {
+		stopAfter()
+		cancel()
+	}
+}
+
 // QueryData handles multiple queries and returns multiple responses.
 // req contains the queries []DataQuery (where each query contains RefID as a unique identifier).
 // The QueryDataResponse contains a map of RefID to the response for each query, and each response
@@ -84,8 +181,11 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 	response := backend.NewQueryDataResponse()
 
 	// loop over queries and execute them individually.
+	ctx = withDashboardPanel(ctx, req)
 	for _, q := range req.Queries {
+		startTime := time.Now()
 		res := d.query(ctx, req.PluginContext, q)
+		d.auditQuery(req.PluginContext, q, res, startTime)
 
 		// save the response in a hashmap
 		// based on with RefID as identifier
@@ -95,10 +195,10 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 	return response, nil
 }
 
-func (d *Datasource) query(ctx context.Context, _ backend.PluginContext, dataQuery backend.DataQuery) backend.DataResponse {
+func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, dataQuery backend.DataQuery) backend.DataResponse {
 	var criblQuery models.CriblQuery
 	if err := json.Unmarshal(dataQuery.JSON, &criblQuery); err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("failed to unmarshal CriblQuery: %v", err.Error()))
+		return errorResponse(invalidQueryError(fmt.Errorf("failed to unmarshal CriblQuery: %v", err.Error())))
 	}
 	backend.Logger.Debug("query", "criblQuery", criblQuery)
 
@@ -112,54 +212,159 @@ func (d *Datasource) query(ctx context.Context, _ backend.PluginContext, dataQue
 		backend.Logger.Debug("can't run query", "err", err)
 		return response // just return the empty response
 	}
+	if err := d.checkQueryPolicy(pCtx.User, &criblQuery); err != nil {
+		backend.Logger.Info("query not allowed", "refId", dataQuery.RefID, "err", err)
+		return errorResponse(err)
+	}
 
 	// Increment the counter metric for this query type
 	queryCounter.WithLabelValues(criblQuery.Type).Inc()
 
-	earliest := dataQuery.TimeRange.From.Unix()
-	latest := dataQuery.TimeRange.To.Unix()
+	// Job history isn't a search at all, it's a simple listing
+	if criblQuery.Type == "jobs" {
+		return d.queryJobs(&criblQuery, dataQuery)
+	}
 
-	queryParams := url.Values{}
-	if criblQuery.Type == "adhoc" {
-		queryParams.Set("query", prepareQuery(criblQuery.Query))
-		queryParams.Set("earliest", strconv.FormatInt(earliest, 10))
-		queryParams.Set("latest", strconv.FormatInt(latest, 10))
-	} else {
-		// Saved/scheduled queries have their own earliest/latest timeframe pre-defined
-		queryParams.Set("queryId", criblQuery.SavedSearchId)
+	crumb := d.newBreadcrumb(ctx, pCtx, dataQuery.RefID, criblQuery.JobTags)
+	queryParams, meta, err := d.buildQueryParams(&criblQuery, dataQuery.TimeRange, crumb)
+	if err != nil {
+		return errorResponse(err)
+	}
+	// The breadcrumb is left out, since the frame may be cached or shared with other users' identical queries
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: stripBreadcrumb(queryParams.Get("query")), Custom: meta}
+
+	// Validate gap filling up front, no sense running the query if we can't fill it
+	var fillInterval time.Duration
+	if criblQuery.FillMode != "" && criblQuery.FillMode != FILL_MODE_NONE {
+		interval, err := resolveFillInterval(criblQuery.FillInterval, queryParams.Get("query"))
+		if err != nil {
+			return errorResponse(invalidQueryError(err))
+		}
+		fillInterval = interval
 	}
+
+	// Identical queries over (nearly) the same time range can share results
+	timeFields := resolveTimeFields(d.Settings, &criblQuery)
+	cacheKey := ""
+	if d.cache != nil && !criblQuery.BypassCache {
+		cacheKey = d.cache.key(d.Settings.CriblOrgBaseUrl, queryParams, &criblQuery, timeFields)
+		if frames, ok := d.cache.get(cacheKey, time.Now()); ok {
+			backend.Logger.Debug("using cached results", "cacheKey", cacheKey)
+			cacheHitCounter.WithLabelValues(criblQuery.Type).Inc()
+			for _, cached := range frames {
+				cached.RefID = dataQuery.RefID
+			}
+			return backend.DataResponse{Frames: frames}
+		}
+		cacheMissCounter.WithLabelValues(criblQuery.Type).Inc()
+	}
+
+	// Identical queries running at the same time share a single job
+	flightKey := queryKey(d.Settings.CriblOrgBaseUrl, queryParams, &criblQuery, timeFields, 0)
+	response, shared := d.flights.do(ctx, flightKey, func(ctx context.Context) backend.DataResponse {
+		ctx, cancel := d.withLifetime(ctx)
+		defer cancel()
+		return d.cacheResponse(cacheKey, d.runQuery(ctx, &criblQuery, dataQuery.TimeRange, queryParams, crumb, meta, frame, timeFields, fillInterval))
+	})
+	if shared {
+		backend.Logger.Debug("shared results of an identical query", "refId", dataQuery.RefID)
+		response = withRefID(response, dataQuery.RefID)
+	}
+	return response
+}
+
+// Run the job(s) for a query, given the API params of its initial request, building the frame from the results
+func (d *Datasource) runQuery(ctx context.Context, criblQuery *models.CriblQuery, timeRange backend.TimeRange, queryParams url.Values, crumb *breadcrumb, meta *CriblFrameMeta, frame *data.Frame, timeFields map[string]bool, fillInterval time.Duration) backend.DataResponse {
+	var response backend.DataResponse
+	response.Frames = append(response.Frames, frame)
 	backend.Logger.Debug("running query", "queryParams", queryParams)
 
+	builder := newFrameBuilder(frame, timeFields)
+
+	// A summarized time series can be refreshed incrementally, only querying buckets since the last refresh
+	if criblQuery.Type == "adhoc" && criblQuery.Incremental {
+		interval, err := resolveFillInterval(criblQuery.FillInterval, queryParams.Get("query"))
+		if err != nil {
+			return errorResponse(invalidQueryError(fmt.Errorf("incremental refresh requires a bin() in the query: %v", err.Error())))
+		}
+		if err := d.queryIncremental(ctx, criblQuery, queryParams.Get("query"), queryTimeout(d.Settings, criblQuery), interval, timeRange, builder, meta); err != nil {
+			return queryErrorResponse(err, criblQuery, frame, meta)
+		}
+		builder.finish()
+		return fillResponse(response, criblQuery, fillInterval, timeRange)
+	}
+
+	// A long time range can be split into chunks, run as concurrent jobs, to keep each job reasonably sized
+	if criblQuery.Type == "adhoc" && len(strings.TrimSpace(criblQuery.ChunkInterval)) > 0 {
+		chunkInterval, err := parseKqlTimespan(criblQuery.ChunkInterval)
+		if err != nil {
+			return errorResponse(invalidQueryError(fmt.Errorf("invalid chunk interval: %v", err.Error())))
+		}
+		notices, err := d.queryChunked(ctx, queryParams.Get("query"), queryTimeout(d.Settings, criblQuery), chunkInterval, timeRange, builder, meta)
+		if err != nil {
+			return queryErrorResponse(err, criblQuery, frame, meta)
+		}
+		builder.finish()
+		frame.AppendNotices(notices...)
+		return fillResponse(response, criblQuery, fillInterval, timeRange)
+	}
+
 	eventCount := 0
 	totalEventCount := -1
-	maxQueryDuration := time.Duration(0)
-	if d.Settings.QueryTimeoutSec != nil {
-		maxQueryDuration = time.Duration(*d.Settings.QueryTimeoutSec * 1e9)
-	}
-	backend.Logger.Info("timeout will be", "maxQueryDuration", maxQueryDuration, "queryTimeoutSec", d.Settings.QueryTimeoutSec)
+	maxQueryDuration := queryTimeout(d.Settings, criblQuery)
+	backend.Logger.Info("timeout will be", "maxQueryDuration", maxQueryDuration, "queryTimeoutSec", d.Settings.QueryTimeoutSec, "queryOverride", criblQuery.TimeoutSec)
 	startTime := time.Now()
 
 	// Load the search results, paging through until we've hit MAX_RESULTS or read all events, whatever comes first
-	a, b := 100*time.Millisecond, 100*time.Millisecond // for Fibonacci backoff
+	schedule := newPollSchedule(d.Settings)
+	isFirstResponse := true
 	for {
+		if ctx.Err() != nil {
+			return errorResponse(queryCanceledError())
+		}
 		queryParams.Set("offset", strconv.Itoa(eventCount))
-		queryParams.Set("limit", strconv.Itoa(MAX_RESULTS))
+		queryParams.Set("limit", strconv.Itoa(QUERY_PAGE_SIZE))
 
 		result, err := d.SearchAPI.RunQueryAndGetResults(&queryParams)
 		if err != nil {
 			backend.Logger.Debug("query failed", "err", err)
-			return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+			return queryErrorResponse(err, criblQuery, frame, meta)
 		}
 		backend.Logger.Debug("got query response", "header", result.Header)
 
 		job := result.Header["job"].(map[string]interface{})
 		if job == nil || job["id"] == nil {
 			// Never expected to happen, but just in case, let's bail to prevent a screwy loop
-			return backend.ErrDataResponse(backend.StatusBadRequest, "Unexpected error: response header line has no job or job id")
+			return errorResponse(badGatewayError(errors.New("Unexpected error: response header line has no job or job id")))
 		}
 		jobId := job["id"].(string)
+		meta.JobId = jobId
 		status := job["status"].(string)
 
+		// The first response for a saved search's cached results tells us whether there were any cached results, and
+		// how old they are.  Apply the query's freshness policy before going any further.
+		if isFirstResponse && meta.SavedSearchMode == SAVED_SEARCH_MODE_CACHED {
+			isFirstResponse = false
+			rerun, err := shouldRerunCachedResults(criblQuery, job, result.Header["isFinished"].(bool), time.Now())
+			if err != nil {
+				// Cribl already kicked off a new job in lieu of cached results, which we don't want
+				d.cancelQuery(jobId, err.Error())
+				return errorResponse(invalidQueryError(err))
+			}
+			if rerun {
+				backend.Logger.Debug("cached results are stale, re-running saved search", "jobId", jobId)
+				rerunQuery := *criblQuery
+				rerunQuery.SavedSearchMode = SAVED_SEARCH_MODE_SAVED_RANGE
+				queryParams, meta, err = d.buildQueryParams(&rerunQuery, timeRange, crumb)
+				if err != nil {
+					return errorResponse(err)
+				}
+				frame.Meta = &data.FrameMeta{ExecutedQueryString: stripBreadcrumb(queryParams.Get("query")), Custom: meta}
+				continue
+			}
+		}
+		isFirstResponse = false
+
 		// After the first request, start passing jobId instead of queryId.  This serves two key purposes:
 		//
 		// 1. Ensure we don't mix result sets from different jobs.  This could happen if a scheduled search runs right in the
@@ -176,117 +381,268 @@ func (d *Datasource) query(ctx context.Context, _ backend.PluginContext, dataQue
 		// is isFinished=true, and we can trust totalEventCount as final.  If there were no cached results, Cribl kicks off a
 		// new job, and we get isFinished=false.  When this is the case, grab the job ID and poll until the job is finished.
 		if !result.Header["isFinished"].(bool) {
-			elapsed := time.Since(startTime)
-			// If there's a configured timeout, ensure we don't let the query run longer than that
-			if maxQueryDuration > 0 && elapsed >= maxQueryDuration {
-				backend.Logger.Debug("query timed out, canceling", "jobId", jobId)
-				d.cancelQuery(jobId, "query timed out")
-				return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Job %s still not finished after %v (status=%v). Consider using a scheduled search to speed this up. https://docs.cribl.io/search/scheduled-searches/", jobId, maxQueryDuration, status))
+			// Poll the job's status until it's finished, which is much cheaper than fetching results each time.
+			// If there's a configured timeout, ensure we don't let the query run longer than that.
+			waitCtx, cancelWait := context.WithCancel(ctx)
+			if maxQueryDuration > 0 {
+				waitCtx, cancelWait = context.WithDeadline(ctx, startTime.Add(maxQueryDuration))
 			}
-			a, b = b, a+b // Fibonacci backoff
-			backoffDuration := a
-			if backoffDuration > MAX_BACKOFF_DURATION {
-				backoffDuration = MAX_BACKOFF_DURATION
+			finalStatus, err := d.SearchAPI.waitForJob(waitCtx, jobId, schedule)
+			cancelWait()
+			if len(finalStatus) > 0 {
+				status = finalStatus
 			}
-			backend.Logger.Debug("query not finished, delaying/backing off", "backoffDuration", backoffDuration.String())
-			select {
-			case <-ctx.Done():
-				err := ctx.Err()
-				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-					d.cancelQuery(jobId, err.Error())
-					return backend.ErrDataResponse(backend.StatusBadRequest, "Query Canceled")
+			switch {
+			case ctx.Err() != nil:
+				if criblQuery.Type != "job" {
+					d.cancelQuery(jobId, ctx.Err().Error())
 				}
-			case <-time.After(backoffDuration):
-				continue
+				return errorResponse(queryCanceledError())
+			case errors.Is(err, context.DeadlineExceeded):
+				// Jobs we merely attached to belong to someone else, leave them running
+				if criblQuery.Type != "job" {
+					backend.Logger.Debug("query timed out, canceling", "jobId", jobId)
+					d.cancelQuery(jobId, "query timed out")
+				}
+				if criblQuery.PartialResults {
+					return d.partialResults(ctx, criblQuery, jobId, status, time.Since(startTime), builder, response, timeRange, fillInterval)
+				}
+				return errorResponse(timeoutError(fmt.Errorf("Job %s still not finished after %v (status=%v). Consider using a scheduled search to speed this up. https://docs.cribl.io/search/scheduled-searches/", jobId, maxQueryDuration, status)))
+			case err != nil:
+				return errorResponse(err)
 			}
+			backend.Logger.Debug("job finished, fetching results", "jobId", jobId, "status", status)
 			continue
 		}
 
 		backend.Logger.Debug("Job finished", "jobId", jobId, "status", status)
 		if status != "completed" {
-			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Job %s ended with status %s", jobId, status))
+			return errorResponse(invalidQueryError(fmt.Errorf("Job %s ended with status %s", jobId, status)))
+		}
+		if completedAt, ok := jobTime(job, "timeCompleted"); ok {
+			meta.JobCompletedAt = &completedAt
 		}
 
 		// The job is finished, so we can trust totalEventCount now, and we can proceed with getting the results
 		totalEventCount = int(result.Header["totalEventCount"].(float64))
 
 		for _, event := range result.Events {
-			// Grab the keys and values from the event and populate fields in the frame
-			for fieldName, value := range event {
-				if fieldName == CRIBL_TIME_FIELD {
-					// Two things are happening here:
-					// 1. Instead of our "_time" we use Grafana's well-known "time" field name.
-					// 2. Convert from seconds to time.Time struct.  If the conversion fails, _time must be something
-					// other than seconds, and it will pass-through as is with the original "_time" field name.
-					if ok, time := criblTimeToGrafanaTime(value); ok {
-						fieldName = GRAFANA_TIME_FIELD_NAME
-						value = time
-					}
-				}
+			builder.addEvent(event)
+			resultsCounter.WithLabelValues(criblQuery.Type).Inc()
+		}
+		eventCount = builder.eventCount
 
-				// Grafana doesn't like nested objects.  Convert it to a string as needed
-				value = flattenNestedObjectToString(value)
-
-				// Establish the field if it we haven't seen it yet
-				field, fieldIdx := frame.FieldByName(fieldName)
-				if fieldIdx == -1 {
-					arr, err := makeEmptyConcreteTypeArray(value)
-					if err != nil {
-						backend.Logger.Warn("unable to add field", "fieldName", fieldName, "reason", err.Error())
-						continue
-					}
-					field = data.NewField(fieldName, nil, arr)
-
-					if eventCount > 0 {
-						field.Extend(eventCount)
-					}
-
-					backend.Logger.Debug("adding field", "fieldName", fieldName)
-					frame.Fields = append(frame.Fields, field)
-				}
-				field.Append(value)
-
-				// Track min/max if it's a number field
-				switch f := value.(type) {
-				case float64:
-					cf := data.ConfFloat64(f)
-					if field.Config == nil {
-						field.Config = &data.FieldConfig{Min: &cf, Max: &cf}
-					} else {
-						if cf < *field.Config.Min {
-							field.Config.Min = &cf
-						}
-						if cf > *field.Config.Max {
-							field.Config.Max = &cf
-						}
-					}
-				}
-			}
+		// A finished job which returns a short page has no more events, whatever its totalEventCount says
+		exhausted := len(result.Events) < QUERY_PAGE_SIZE
 
-			eventCount++
-			resultsCounter.WithLabelValues(criblQuery.Type).Inc()
+		// Now that we know how many results there are, fetch the rest in parallel
+		if remaining := min(totalEventCount, MAX_RESULTS); eventCount < remaining && !exhausted {
+			events, err := d.SearchAPI.FetchPages(ctx, jobId, eventCount, remaining)
+			if err != nil {
+				return errorResponse(err)
+			}
+			for _, event := range events {
+				builder.addEvent(event)
+				resultsCounter.WithLabelValues(criblQuery.Type).Inc()
+			}
+			exhausted = len(events) < remaining-eventCount
+			eventCount = builder.eventCount
 		}
 
 		backend.Logger.Debug("after processing events", "totalEventCount", totalEventCount, "eventCount", eventCount, "status", status)
 		if eventCount >= MAX_RESULTS || (totalEventCount != -1 && eventCount >= totalEventCount) {
 			break
 		}
+		if exhausted {
+			backend.Logger.Warn("job returned fewer events than its totalEventCount", "jobId", jobId, "totalEventCount", totalEventCount, "eventCount", eventCount)
+			break
+		}
 	}
 
-	// Grafana is strict about every field needing to have the same length (# of values).
-	// If a field appeared in only some events, it may be missing values for later events.
-	// Apparently sparse data causes problems for some reason.  Whatever, Grafana.  So we
-	// must "extend" any sparse fields to the full length (lame, Grafana, lame).
-	for _, field := range frame.Fields {
-		if field.Len() < eventCount {
-			backend.Logger.Debug("extending field length", "fieldName", field.Name, "len", field.Len())
-			field.Extend(eventCount - field.Len())
+	builder.finish()
+
+	return fillResponse(response, criblQuery, fillInterval, timeRange)
+}
+
+// Cache a successful response under the key (if any), passing the response through
+func (d *Datasource) cacheResponse(cacheKey string, response backend.DataResponse) backend.DataResponse {
+	if len(cacheKey) > 0 && isCacheableResponse(response) {
+		d.cache.put(cacheKey, response.Frames, time.Now())
+	}
+	return response
+}
+
+// Respond with the results a job produced before the query timed out, marked with a warning notice
+func (d *Datasource) partialResults(ctx context.Context, criblQuery *models.CriblQuery, jobId string, status string, elapsed time.Duration, builder *frameBuilder, response backend.DataResponse, timeRange backend.TimeRange, fillInterval time.Duration) backend.DataResponse {
+	queryParams := url.Values{}
+	queryParams.Set("jobId", jobId)
+	queryParams.Set("offset", "0")
+	queryParams.Set("limit", strconv.Itoa(QUERY_PAGE_SIZE))
+	result, err := d.SearchAPI.RunQueryAndGetResults(&queryParams)
+	if err != nil {
+		return errorResponse(fmt.Errorf("Job %s timed out, and its partial results couldn't be fetched: %w", jobId, err))
+	}
+	events := result.Events
+	if total := min(totalEventCountOf(result.Header), MAX_RESULTS); len(events) > 0 && len(events) < total {
+		rest, err := d.SearchAPI.FetchPages(ctx, jobId, len(events), total)
+		if err != nil {
+			return errorResponse(fmt.Errorf("Job %s timed out, and its partial results couldn't be fetched: %w", jobId, err))
 		}
+		events = append(events, rest...)
+	}
+	for _, event := range events {
+		builder.addEvent(event)
+		resultsCounter.WithLabelValues(criblQuery.Type).Inc()
 	}
+	builder.finish()
+
+	backend.Logger.Debug("returning partial results of timed out query", "jobId", jobId, "eventCount", builder.eventCount)
+	response.Frames[0].AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("Partial results: job %s was still %s after %v, these are the %d events it had produced.", jobId, status, elapsed.Round(time.Millisecond), builder.eventCount),
+	})
+	return fillResponse(response, criblQuery, fillInterval, timeRange)
+}
 
+// Summarized time series may be missing buckets where there were no events, fill them in if requested
+func fillResponse(response backend.DataResponse, criblQuery *models.CriblQuery, fillInterval time.Duration, timeRange backend.TimeRange) backend.DataResponse {
+	if fillInterval > 0 {
+		filled, err := fillMissingBuckets(response.Frames[0], criblQuery.FillMode, fillInterval, timeRange)
+		if err != nil {
+			return errorResponse(invalidQueryError(err))
+		}
+		response.Frames[0] = filled
+	}
 	return response
 }
 
+// Custom frame metadata describing how the results were produced
+type CriblFrameMeta struct {
+	SavedSearchMode string     `json:"savedSearchMode,omitempty"` // for saved searches, see models.CriblQuery.SavedSearchMode
+	JobId           string     `json:"jobId,omitempty"`           // ID of the Cribl job whose results were used
+	JobCompletedAt  *time.Time `json:"jobCompletedAt,omitempty"`  // when that job completed
+
+	// Progress of a streamed query
+	JobStatus  string `json:"jobStatus,omitempty"`
+	EventCount int    `json:"eventCount,omitempty"`
+	Finished   bool   `json:"finished,omitempty"`
+
+	// For a query split into chunks, how many chunks there were, and how many failed
+	Chunks       int `json:"chunks,omitempty"`
+	FailedChunks int `json:"failedChunks,omitempty"`
+
+	// For an incremental refresh, the start of the window queried (earlier buckets were retained)
+	IncrementalFrom *time.Time `json:"incrementalFrom,omitempty"`
+
+	// For a failed ad-hoc query, where Cribl found the error in the query
+	ErrorLocation *QueryErrorLocation `json:"errorLocation,omitempty"`
+
+	// Where (in characters) a clause restricting the datasets was inserted into the query, and its length
+	restrictionAt     int
+	restrictionLength int
+}
+
+// The Cribl metadata of a frame, or nil if it has none.  A frame built by this plugin has a
+// *CriblFrameMeta, but one decoded from JSON (i.e. from the result cache) has a generic map, which is
+// decoded again.
+func criblFrameMetaOf(frame *data.Frame) *CriblFrameMeta {
+	if frame.Meta == nil || frame.Meta.Custom == nil {
+		return nil
+	}
+	if meta, ok := frame.Meta.Custom.(*CriblFrameMeta); ok {
+		return meta
+	}
+	encoded, err := json.Marshal(frame.Meta.Custom)
+	if err != nil {
+		return nil
+	}
+	var meta CriblFrameMeta
+	if err := json.Unmarshal(encoded, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+// Build the API params for the initial request of a query.  Ad-hoc queries run against the query's
+// time range.  Saved searches normally use their cached/scheduled results, but can optionally re-run
+// the saved search's query text with either its own time range or the dashboard's.  The breadcrumb
+// identifies the query in the search job history, and may be nil.
+func (d *Datasource) buildQueryParams(criblQuery *models.CriblQuery, timeRange backend.TimeRange, crumb *breadcrumb) (url.Values, *CriblFrameMeta, error) {
+	queryParams := url.Values{}
+	meta := &CriblFrameMeta{}
+	earliest, latest := criblTimeRange(criblQuery, timeRange)
+
+	switch criblQuery.Type {
+	case "adhoc":
+		query, err := applyAdhocFilters(criblQuery.Query, criblQuery.AdhocFilters)
+		if err != nil {
+			return nil, nil, invalidQueryError(err)
+		}
+		query, meta.restrictionAt, meta.restrictionLength = restrictDatasets(d.Settings, query)
+		queryParams.Set("query", prepareQuery(query, crumb))
+		queryParams.Set("earliest", earliest)
+		queryParams.Set("latest", latest)
+	case "saved":
+		meta.SavedSearchMode = criblQuery.SavedSearchMode
+		if meta.SavedSearchMode == "" {
+			meta.SavedSearchMode = SAVED_SEARCH_MODE_CACHED
+		}
+		if criblQuery.SavedSearchFreshness == SAVED_SEARCH_FRESHNESS_MAX_AGE && criblQuery.MaxAgeMinutes <= 0 {
+			// Otherwise any cached results would be too old, the same as "always"
+			return nil, nil, invalidQueryError(fmt.Errorf("the max age freshness policy needs a max age of more than 0 minutes"))
+		}
+		if meta.SavedSearchMode == SAVED_SEARCH_MODE_CACHED && criblQuery.SavedSearchFreshness == SAVED_SEARCH_FRESHNESS_ALWAYS {
+			meta.SavedSearchMode = SAVED_SEARCH_MODE_SAVED_RANGE // never use cached results
+		}
+		switch meta.SavedSearchMode {
+		case SAVED_SEARCH_MODE_CACHED:
+			// Saved/scheduled queries have their own earliest/latest timeframe pre-defined
+			queryParams.Set("queryId", criblQuery.SavedSearchId)
+		case SAVED_SEARCH_MODE_SAVED_RANGE, SAVED_SEARCH_MODE_DASHBOARD_RANGE:
+			savedSearch, err := d.SearchAPI.LoadSavedSearch(criblQuery.SavedSearchId)
+			if err != nil {
+				return nil, nil, err
+			}
+			queryParams.Set("query", prepareQuery(savedSearch.Query, crumb))
+			if meta.SavedSearchMode == SAVED_SEARCH_MODE_SAVED_RANGE {
+				earliest, latest = savedSearch.TimeRange()
+			}
+			queryParams.Set("earliest", earliest)
+			queryParams.Set("latest", latest)
+		default:
+			return nil, nil, invalidQueryError(fmt.Errorf("unsupported saved search mode: %v", criblQuery.SavedSearchMode))
+		}
+	case "job":
+		// An existing job, which has its own query and time range
+		queryParams.Set("jobId", strings.TrimSpace(criblQuery.JobId))
+	}
+	return queryParams, meta, nil
+}
+
+// Decide whether to use the cached results of a saved search, per the query's freshness policy,
+// given the job from the first response.  Returns true if the saved search should be re-run instead,
+// or an error if results must come from the cache but there weren't any.
+func shouldRerunCachedResults(criblQuery *models.CriblQuery, job map[string]interface{}, isFinished bool, now time.Time) (bool, error) {
+	switch criblQuery.SavedSearchFreshness {
+	case SAVED_SEARCH_FRESHNESS_CACHE_ONLY:
+		if !isFinished {
+			return false, fmt.Errorf("Saved search %s has no cached results.  Check that it's scheduled, or choose a different freshness policy.", criblQuery.SavedSearchId)
+		}
+	case SAVED_SEARCH_FRESHNESS_MAX_AGE:
+		if !isFinished {
+			return false, nil // Cribl already kicked off a new job, so the results will be fresh
+		}
+		completedAt, ok := jobTime(job, "timeCompleted")
+		if !ok {
+			backend.Logger.Warn("unable to determine when cached results were produced, using them anyway", "jobId", job["id"])
+			return false, nil
+		}
+		maxAge := time.Duration(criblQuery.MaxAgeMinutes * float64(time.Minute))
+		return now.Sub(completedAt) > maxAge, nil
+	}
+	return false, nil
+}
+
 // CheckHealth handles health checks sent from Grafana to the plugin.
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
@@ -319,18 +675,79 @@ func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResource
 	return d.ResourceHandler.CallResource(ctx, req, sender)
 }
 
+// Handle a request for the IDs of saved searches, less any the data source doesn't allow
 func (d *Datasource) handleSavedSearchIds(w http.ResponseWriter, r *http.Request) {
 	ids, err := d.SearchAPI.LoadSavedSearchIds()
 	if err != nil {
 		backend.Logger.Error("error loading saved search IDs", "err", err)
 		return
 	}
+	ids = slices.DeleteFunc(ids, func(id string) bool { return !isAllowedSavedSearch(d.Settings, id) })
 	body, _ := json.Marshal(ids)
 	w.Header().Add("Content-Type", "application/json")
 	w.Write(body)
 	w.WriteHeader(http.StatusOK)
 }
 
+// Handle a request for the field names to offer as ad hoc filter keys.  Accepts optional "query",
+// "earliest" and "latest" params to scope which events are sampled.
+func (d *Datasource) handleTagKeys(w http.ResponseWriter, r *http.Request) {
+	query, earliest, latest := tagQueryParams(r)
+	if !d.checkResourcePolicy(w, backend.PluginConfigFromContext(r.Context()).User, query) {
+		return
+	}
+	query, _, _ = restrictDatasets(d.Settings, query)
+	keys, err := d.SearchAPI.LoadFieldNames(r.Context(), query, earliest, latest)
+	if err != nil {
+		backend.Logger.Error("error loading tag keys", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, _ := json.Marshal(keys)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Handle a request for the values to offer for an ad hoc filter key.  Requires a "key" param,
+// and accepts the same optional params as handleTagKeys.
+func (d *Datasource) handleTagValues(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if len(key) == 0 {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	query, earliest, latest := tagQueryParams(r)
+	if !d.checkResourcePolicy(w, backend.PluginConfigFromContext(r.Context()).User, query) {
+		return
+	}
+	query, _, _ = restrictDatasets(d.Settings, query)
+	values, err := d.SearchAPI.LoadFieldValues(r.Context(), query, key, earliest, latest)
+	if err != nil {
+		backend.Logger.Error("error loading tag values", "key", key, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, _ := json.Marshal(values)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Pluck the query and time range used to sample events for the ad hoc filter UI, with defaults
+func tagQueryParams(r *http.Request) (string, string, string) {
+	params := r.URL.Query()
+	query, earliest, latest := params.Get("query"), params.Get("earliest"), params.Get("latest")
+	if len(strings.TrimSpace(query)) == 0 {
+		query = DEFAULT_TAG_QUERY
+	}
+	if len(earliest) == 0 {
+		earliest = "-1h"
+	}
+	if len(latest) == 0 {
+		latest = "now"
+	}
+	return query, earliest, latest
+}
+
 func (d *Datasource) cancelQuery(jobId string, reason string) error {
 	err := d.SearchAPI.CancelQuery(jobId)
 	if err != nil {
@@ -2,9 +2,17 @@ package plugin
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/criblcloud/search-datasource/pkg/models"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestQueryData(t *testing.T) {
@@ -26,3 +34,222 @@ func TestQueryData(t *testing.T) {
 		t.Fatal("QueryData must return a response")
 	}
 }
+
+// Create a Datasource whose SearchAPI talks to a test server, with a pre-established bearer token
+// so no auth requests are made
+func newTestDatasource(t *testing.T, handler http.HandlerFunc) *Datasource {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	settings := &models.PluginSettings{CriblOrgBaseUrl: server.URL, Secrets: &models.SecretPluginSettings{}}
+	ds := &Datasource{Settings: settings, SearchAPI: NewSearchAPI(settings)}
+	ds.SearchAPI.BearerToken = &BearerToken{Token: "test", ExpiresAt: time.Now().Add(time.Hour).UnixMilli()}
+	return ds
+}
+
+func TestBuildQueryParams(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/m/default_search/search/saved/my_search", r.URL.Path)
+		w.Write([]byte(`{"items":[{"id":"my_search","query":"dataset=\"foo\" | limit 10","earliest":"-24h","latest":"now"}]}`))
+	})
+	timeRange := backend.TimeRange{From: time.UnixMilli(1728744793123), To: time.UnixMilli(1728748393456)}
+
+	params, meta, err := ds.buildQueryParams(&models.CriblQuery{Type: "adhoc", Query: "dataset=\"foo\""}, timeRange, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "dataset=\"foo\"\n// Grafana plugin", params.Get("query"))
+	assert.Equal(t, "1728744793.123", params.Get("earliest"))
+	assert.Equal(t, "", meta.SavedSearchMode)
+
+	params, meta, err = ds.buildQueryParams(&models.CriblQuery{Type: "saved", SavedSearchId: "my_search"}, timeRange, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "my_search", params.Get("queryId"))
+	assert.Equal(t, "", params.Get("query"))
+	assert.Equal(t, SAVED_SEARCH_MODE_CACHED, meta.SavedSearchMode)
+
+	params, meta, err = ds.buildQueryParams(&models.CriblQuery{Type: "saved", SavedSearchId: "my_search", SavedSearchMode: SAVED_SEARCH_MODE_SAVED_RANGE}, timeRange, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", params.Get("queryId"))
+	assert.Equal(t, "dataset=\"foo\" | limit 10\n// Grafana plugin", params.Get("query"))
+	assert.Equal(t, "-24h", params.Get("earliest"))
+	assert.Equal(t, "now", params.Get("latest"))
+	assert.Equal(t, SAVED_SEARCH_MODE_SAVED_RANGE, meta.SavedSearchMode)
+
+	params, meta, err = ds.buildQueryParams(&models.CriblQuery{Type: "saved", SavedSearchId: "my_search", SavedSearchMode: SAVED_SEARCH_MODE_DASHBOARD_RANGE}, timeRange, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "1728744793.123", params.Get("earliest"))
+	assert.Equal(t, "1728748393.456", params.Get("latest"))
+	assert.Equal(t, SAVED_SEARCH_MODE_DASHBOARD_RANGE, meta.SavedSearchMode)
+
+	_, _, err = ds.buildQueryParams(&models.CriblQuery{Type: "saved", SavedSearchId: "my_search", SavedSearchMode: "bogus"}, timeRange, nil)
+	assert.NotNil(t, err)
+
+	params, _, err = ds.buildQueryParams(&models.CriblQuery{Type: "job", JobId: " 1728744793123.abcdef "}, timeRange, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "1728744793123.abcdef", params.Get("jobId"))
+	assert.Equal(t, "", params.Get("earliest"), "existing jobs have their own time range")
+}
+
+func TestShouldRerunCachedResults(t *testing.T) {
+	now := time.UnixMilli(1728748393000)
+	freshJob := map[string]interface{}{"id": "fresh", "timeCompleted": float64(now.Add(-5 * time.Minute).UnixMilli())}
+	staleJob := map[string]interface{}{"id": "stale", "timeCompleted": float64(now.Add(-2 * time.Hour).UnixMilli())}
+	newJob := map[string]interface{}{"id": "new"}
+
+	for _, test := range []struct {
+		Freshness  string
+		Job        map[string]interface{}
+		IsFinished bool
+		Rerun      bool
+		Err        bool
+	}{
+		{Freshness: SAVED_SEARCH_FRESHNESS_DEFAULT, Job: staleJob, IsFinished: true},
+		{Freshness: SAVED_SEARCH_FRESHNESS_DEFAULT, Job: newJob, IsFinished: false},
+		{Freshness: SAVED_SEARCH_FRESHNESS_MAX_AGE, Job: freshJob, IsFinished: true},
+		{Freshness: SAVED_SEARCH_FRESHNESS_MAX_AGE, Job: staleJob, IsFinished: true, Rerun: true},
+		{Freshness: SAVED_SEARCH_FRESHNESS_MAX_AGE, Job: newJob, IsFinished: false},
+		{Freshness: SAVED_SEARCH_FRESHNESS_CACHE_ONLY, Job: staleJob, IsFinished: true},
+		{Freshness: SAVED_SEARCH_FRESHNESS_CACHE_ONLY, Job: newJob, IsFinished: false, Err: true},
+	} {
+		query := &models.CriblQuery{Type: "saved", SavedSearchId: "s", SavedSearchFreshness: test.Freshness, MaxAgeMinutes: 60}
+		rerun, err := shouldRerunCachedResults(query, test.Job, test.IsFinished, now)
+		assert.Equal(t, test.Rerun, rerun, test)
+		assert.Equal(t, test.Err, err != nil, test)
+	}
+}
+
+func TestBuildQueryParamsAlwaysRerun(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items":[{"id":"my_search","query":"dataset=\"foo\"","earliest":"-1h","latest":"now"}]}`))
+	})
+	query := &models.CriblQuery{Type: "saved", SavedSearchId: "my_search", SavedSearchFreshness: SAVED_SEARCH_FRESHNESS_ALWAYS}
+	params, meta, err := ds.buildQueryParams(query, backend.TimeRange{}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", params.Get("queryId"), "cached results are never used")
+	assert.Equal(t, "-1h", params.Get("earliest"))
+	assert.Equal(t, SAVED_SEARCH_MODE_SAVED_RANGE, meta.SavedSearchMode)
+}
+
+func TestBuildQueryParamsMaxAgeRequired(t *testing.T) {
+	ds := newTestDatasource(t, nil)
+	for _, maxAgeMinutes := range []float64{0, -5} {
+		query := &models.CriblQuery{Type: "saved", SavedSearchId: "my_search", SavedSearchFreshness: SAVED_SEARCH_FRESHNESS_MAX_AGE, MaxAgeMinutes: maxAgeMinutes}
+		_, _, err := ds.buildQueryParams(query, backend.TimeRange{}, nil)
+		assert.NotNil(t, err, "max age %v", maxAgeMinutes)
+		assert.Equal(t, backend.StatusBadRequest, errorResponse(err).Status)
+	}
+	query := &models.CriblQuery{Type: "saved", SavedSearchId: "my_search", SavedSearchFreshness: SAVED_SEARCH_FRESHNESS_MAX_AGE, MaxAgeMinutes: 30}
+	params, _, err := ds.buildQueryParams(query, backend.TimeRange{}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "my_search", params.Get("queryId"))
+}
+
+func TestQueryStopsOnShortResults(t *testing.T) {
+	// The job claims more events than it has: a short first page, or nothing after the first page
+	for _, test := range []struct {
+		Total        int
+		FirstPage    int
+		ExpectedRows int
+	}{
+		{5, 2, 2},
+		{QUERY_PAGE_SIZE + 500, QUERY_PAGE_SIZE, QUERY_PAGE_SIZE},
+	} {
+		requests := 0
+		ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(fmt.Sprintf(`{"isFinished":true,"totalEventCount":%d,"job":{"id":"j1","status":"completed"}}`, test.Total)))
+			if r.URL.Query().Get("offset") == "0" {
+				w.Write([]byte(strings.Repeat("\n"+`{"n":1}`, test.FirstPage)))
+			}
+		})
+		timeRange := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+		res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`)})
+		assert.Nil(t, res.Error)
+		assert.LessOrEqual(t, requests, 2, "%+v", test)
+		assert.Equal(t, test.ExpectedRows, res.Frames[0].Rows(), "%+v", test)
+	}
+}
+
+func TestQueryCanceled(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("nothing is sent once the query is canceled")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	timeRange := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+	res := ds.query(ctx, backend.PluginContext{}, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`)})
+	assert.NotNil(t, res.Error)
+}
+
+func TestDispose(t *testing.T) {
+	// The job never finishes, until it's canceled
+	canceled := make(chan string, 10)
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/cancel") {
+			canceled <- r.URL.Path
+			w.Write([]byte(`{}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/status") {
+			w.Write([]byte(`{"items":[{"status":"running"}]}`))
+			return
+		}
+		w.Write([]byte(`{"isFinished":false,"job":{"id":"j1","status":"running"}}`))
+	})
+	ds.lifetime, ds.stop = context.WithCancel(context.Background())
+
+	done := make(chan backend.DataResponse)
+	go func() {
+		done <- ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+			RefID:     "A",
+			TimeRange: backend.TimeRange{From: time.Unix(1728744000, 0), To: time.Unix(1728747600, 0)},
+			JSON:      []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`),
+		})
+	}()
+	assert.Eventually(t, func() bool { return len(ds.SearchAPI.ActiveJobIds()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	ds.Dispose()
+	res := <-done
+	assert.NotNil(t, res.Error, "polling stopped")
+	assert.Equal(t, "/api/v1/m/default_search/search/jobs/j1/cancel", <-canceled)
+	assert.Empty(t, ds.SearchAPI.ActiveJobIds())
+}
+
+func TestQueryTimeoutPartialResults(t *testing.T) {
+	// The job never finishes, but has produced 2 events so far
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/cancel"):
+			w.Write([]byte(`{}`))
+		case strings.HasSuffix(r.URL.Path, "/status"):
+			w.Write([]byte(`{"items":[{"status":"running"}]}`))
+		case r.URL.Query().Has("query"):
+			w.Write([]byte(`{"isFinished":false,"job":{"id":"j1","status":"new"}}`))
+		default:
+			w.Write([]byte(`{"isFinished":true,"totalEventCount":2,"job":{"id":"j1","status":"canceled"}}` + "\n" + `{"n":1}` + "\n" + `{"n":2}`))
+		}
+	})
+	timeout, initial := 0.05, 0.01
+	ds.Settings.QueryTimeoutSec = &timeout
+	ds.Settings.PollInitialDelaySec = &initial
+	run := func(json string) backend.DataResponse {
+		return ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+			RefID:     "A",
+			TimeRange: backend.TimeRange{From: time.Unix(1728744000, 0), To: time.Unix(1728747600, 0)},
+			JSON:      []byte(json),
+		})
+	}
+
+	res := run(`{"type":"adhoc","query":"dataset=\"foo\""}`)
+	assert.NotNil(t, res.Error)
+	assert.Contains(t, res.Error.Error(), "still not finished")
+	assert.Contains(t, res.Error.Error(), "status=running")
+
+	res = run(`{"type":"adhoc","query":"dataset=\"foo\"","partialResults":true}`)
+	assert.Nil(t, res.Error)
+	assert.Equal(t, 2, res.Frames[0].Rows())
+	if assert.Len(t, res.Frames[0].Meta.Notices, 1) {
+		notice := res.Frames[0].Meta.Notices[0]
+		assert.Equal(t, data.NoticeSeverityWarning, notice.Severity)
+		assert.Contains(t, notice.Text, "job j1 was still running after")
+		assert.Contains(t, notice.Text, "2 events")
+	}
+}
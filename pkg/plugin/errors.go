@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// An error classified by what went wrong and whose fault it was, so a failed query can respond with
+// the right status and error source.  Grafana (and alerting on it) uses these to tell a user error
+// or a Cribl outage apart from a bug in the plugin.  Annotate classified errors with %w, not %v, so
+// the classification survives.
+type queryError struct {
+	status backend.Status
+	source backend.ErrorSource
+	err    error
+}
+
+func (e *queryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *queryError) Unwrap() error {
+	return e.err
+}
+
+// Cribl rejected our credentials, or we couldn't get a token
+func unauthorizedError(err error) error {
+	return &queryError{backend.StatusUnauthorized, backend.ErrorSourceDownstream, err}
+}
+
+// Cribl couldn't be reached, or its response made no sense
+func badGatewayError(err error) error {
+	return &queryError{backend.StatusBadGateway, backend.ErrorSourceDownstream, err}
+}
+
+// The query (as written by the user) is invalid, or Cribl ran it and it failed
+func invalidQueryError(err error) error {
+	return &queryError{backend.StatusBadRequest, backend.ErrorSourceDownstream, err}
+}
+
+// Cribl, or the data source's own policy, doesn't allow the user to run the query
+func forbiddenError(err error) error {
+	return &queryError{backend.StatusForbidden, backend.ErrorSourceDownstream, err}
+}
+
+// The query took longer than it was allowed to
+func timeoutError(err error) error {
+	return &queryError{backend.StatusTimeout, backend.ErrorSourceDownstream, err}
+}
+
+// The query was canceled, i.e. the dashboard was closed
+func queryCanceledError() error {
+	return &queryError{backend.StatusBadRequest, backend.ErrorSourceDownstream, errors.New("Query Canceled")}
+}
+
+// Classify a non-OK response from Cribl (or its auth provider) by its HTTP status code
+func httpStatusError(statusCode int, err error) error {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return unauthorizedError(err)
+	case statusCode == http.StatusForbidden:
+		return forbiddenError(err)
+	case statusCode == http.StatusNotFound:
+		return &queryError{backend.StatusNotFound, backend.ErrorSourceDownstream, err}
+	case statusCode == http.StatusTooManyRequests:
+		return &queryError{backend.StatusTooManyRequests, backend.ErrorSourceDownstream, err}
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		return timeoutError(err)
+	case statusCode >= 500:
+		return badGatewayError(err)
+	case statusCode >= 400:
+		// i.e. a KQL syntax error
+		return invalidQueryError(err)
+	}
+	return badGatewayError(err)
+}
+
+// Respond to a failed query with the status and error source of its error.  Timeouts and cancellations
+// that weren't classified along the way are downstream, anything else unclassified is on us (an internal error).
+func errorResponse(err error) backend.DataResponse {
+	var qe *queryError
+	switch {
+	case errors.As(err, &qe):
+		return backend.ErrDataResponseWithSource(qe.status, qe.source, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return backend.ErrDataResponseWithSource(backend.StatusTimeout, backend.ErrorSourceDownstream, err.Error())
+	case errors.Is(err, context.Canceled):
+		return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, err.Error())
+	}
+	return backend.ErrDataResponseWithSource(backend.StatusInternal, backend.ErrorSourcePlugin, err.Error())
+}
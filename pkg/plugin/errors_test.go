@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponse(t *testing.T) {
+	for _, test := range []struct {
+		Err            error
+		ExpectedStatus backend.Status
+		ExpectedSource backend.ErrorSource
+	}{
+		{httpStatusError(http.StatusUnauthorized, errors.New("nope")), backend.StatusUnauthorized, backend.ErrorSourceDownstream},
+		{httpStatusError(http.StatusTooManyRequests, errors.New("slow down")), backend.StatusTooManyRequests, backend.ErrorSourceDownstream},
+		{httpStatusError(http.StatusServiceUnavailable, errors.New("down")), backend.StatusBadGateway, backend.ErrorSourceDownstream},
+		{httpStatusError(http.StatusGatewayTimeout, errors.New("slow")), backend.StatusTimeout, backend.ErrorSourceDownstream},
+		{httpStatusError(http.StatusBadRequest, errors.New("syntax error")), backend.StatusBadRequest, backend.ErrorSourceDownstream},
+		{fmt.Errorf("failed to load saved search foo: %w", unauthorizedError(errors.New("nope"))), backend.StatusUnauthorized, backend.ErrorSourceDownstream},
+		{fmt.Errorf("waiting: %w", context.DeadlineExceeded), backend.StatusTimeout, backend.ErrorSourceDownstream},
+		{errors.New("oops"), backend.StatusInternal, backend.ErrorSourcePlugin},
+	} {
+		res := errorResponse(test.Err)
+		assert.Equal(t, test.ExpectedStatus, res.Status, test.Err.Error())
+		assert.Equal(t, test.ExpectedSource, res.ErrorSource, test.Err.Error())
+		assert.Equal(t, test.Err.Error(), res.Error.Error())
+	}
+}
+
+func TestQueryErrorStatus(t *testing.T) {
+	for _, test := range []struct {
+		StatusCode     int
+		Body           string
+		ExpectedStatus backend.Status
+		ExpectedError  string
+	}{
+		{http.StatusUnauthorized, `{"status":"error","message":"Unauthorized"}`, backend.StatusUnauthorized, "Unauthorized"},
+		{http.StatusTooManyRequests, `too many`, backend.StatusTooManyRequests, "request failed (429): too many"},
+		{http.StatusInternalServerError, `{"status":"error","message":"{\"name\":\"Error\",\"message\":\"boom\"}"}`, backend.StatusBadGateway, "Error: boom"},
+		{http.StatusBadRequest, `{"status":"error","message":"{\"name\":\"ParseError\",\"message\":\"unexpected token\"}"}`, backend.StatusBadRequest, "ParseError: unexpected token"},
+	} {
+		ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.StatusCode)
+			w.Write([]byte(test.Body))
+		})
+		timeRange := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+		res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`)})
+		assert.Equal(t, test.ExpectedStatus, res.Status)
+		assert.Equal(t, backend.ErrorSourceDownstream, res.ErrorSource)
+		assert.Equal(t, test.ExpectedError, res.Error.Error())
+	}
+}
+
+func TestAuthStatusError(t *testing.T) {
+	assert.Equal(t, backend.StatusUnauthorized, errorResponse(authStatusError(http.StatusForbidden, errors.New("bad creds"))).Status)
+	assert.Equal(t, backend.StatusUnauthorized, errorResponse(authStatusError(http.StatusBadRequest, errors.New("invalid_client"))).Status)
+	assert.Equal(t, backend.StatusBadGateway, errorResponse(authStatusError(http.StatusBadGateway, errors.New("down"))).Status)
+}
+
+func TestInvalidQueryErrorSource(t *testing.T) {
+	ds := newTestDatasource(t, nil)
+	timeRange := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+	res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":`)})
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+	assert.Equal(t, backend.ErrorSourceDownstream, res.ErrorSource, "malformed query JSON is the query's fault")
+
+	frame := data.NewFrame("results", data.NewField(GRAFANA_TIME_FIELD_NAME, nil, []time.Time{timeRange.From}))
+	res = fillResponse(backend.DataResponse{Frames: data.Frames{frame}}, &models.CriblQuery{FillMode: "bogus"}, time.Minute, timeRange)
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+	assert.Equal(t, backend.ErrorSourceDownstream, res.ErrorSource, "an unsupported fill mode is the query's fault")
+}
@@ -0,0 +1,304 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Fill modes for missing time buckets, see models.CriblQuery.FillMode
+const (
+	FILL_MODE_NONE     = "none"
+	FILL_MODE_NULL     = "null"
+	FILL_MODE_ZERO     = "zero"
+	FILL_MODE_PREVIOUS = "previous"
+)
+
+const MAX_FILL_BUCKETS = 50000 // guard against a tiny interval over a huge time range
+
+// Matches the span in i.e. "bin(_time, 5m)"
+var binSpanRegex = regexp.MustCompile(`(?i)\bbin\s*\(\s*[^,()]+,\s*([0-9.]+\s*[a-z]+)\s*\)`)
+var kqlTimespanRegex = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*(ms|s|m|h|d)$`)
+
+// Parse a Kusto timespan literal such as "30s", "5m", "1h" or "1d"
+func parseKqlTimespan(timespan string) (time.Duration, error) {
+	match := kqlTimespanRegex.FindStringSubmatch(strings.TrimSpace(timespan))
+	if match == nil {
+		return 0, fmt.Errorf("invalid timespan: %v", timespan)
+	}
+	amount, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timespan: %v", timespan)
+	}
+	unit := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+	}[match[2]]
+	duration := time.Duration(amount * float64(unit))
+	if duration <= 0 {
+		return 0, fmt.Errorf("timespan must be positive: %v", timespan)
+	}
+	return duration, nil
+}
+
+// Determine the bucket interval for gap filling.  An explicit interval wins, otherwise we look for
+// the span used with bin() in the query, i.e. "summarize count() by bin(_time, 5m)".
+func resolveFillInterval(explicitInterval string, query string) (time.Duration, error) {
+	if len(strings.TrimSpace(explicitInterval)) > 0 {
+		return parseKqlTimespan(explicitInterval)
+	}
+	if match := binSpanRegex.FindStringSubmatch(query); match != nil {
+		return parseKqlTimespan(match[1])
+	}
+	return 0, errors.New("fill interval not specified and no bin() found in the query")
+}
+
+// Align a time to the start of its bucket.  Like Kusto's bin(), buckets are aligned to the epoch.
+func bucketStart(t time.Time, interval time.Duration) time.Time {
+	n := t.UnixNano()
+	rem := n % int64(interval)
+	if rem < 0 {
+		rem += int64(interval)
+	}
+	return time.Unix(0, n-rem).UTC()
+}
+
+// Insert rows for any time buckets missing from a summarized result frame.  String and bool fields
+// are treated as series labels (i.e. the "by host" in "summarize count() by bin(_time, 5m), host"),
+// so each series is filled independently.  Numeric fields get a value depending on the fill mode:
+// null, zero, or the series' previous value.  The returned frame has nullable fields, and its rows
+// are ordered by time.
+func fillMissingBuckets(frame *data.Frame, fillMode string, interval time.Duration, timeRange backend.TimeRange) (*data.Frame, error) {
+	switch fillMode {
+	case "", FILL_MODE_NONE:
+		return frame, nil
+	case FILL_MODE_NULL, FILL_MODE_ZERO, FILL_MODE_PREVIOUS:
+	default:
+		return frame, fmt.Errorf("unsupported fill mode: %v", fillMode)
+	}
+	if interval <= 0 {
+		return frame, errors.New("fill interval must be positive")
+	}
+
+	// Prefer Grafana's well-known time field, otherwise the first time field
+	_, timeIdx := frame.FieldByName(GRAFANA_TIME_FIELD_NAME)
+	if timeIdx != -1 && !frame.Fields[timeIdx].Type().Time() {
+		timeIdx = -1
+	}
+	for idx, field := range frame.Fields {
+		if timeIdx == -1 && field.Type().Time() {
+			timeIdx = idx
+		}
+	}
+
+	var labelIdxs, numberIdxs []int
+	for idx, field := range frame.Fields {
+		switch {
+		case idx == timeIdx || field.Type().Time():
+			continue
+		case field.Type().Numeric():
+			numberIdxs = append(numberIdxs, idx)
+		case field.Type().NonNullableType() == data.FieldTypeString || field.Type().NonNullableType() == data.FieldTypeBool:
+			labelIdxs = append(labelIdxs, idx)
+		}
+	}
+	if timeIdx == -1 {
+		return frame, errors.New("unable to fill missing buckets, results have no time field")
+	}
+	rowCount, err := frame.RowLen()
+	if err != nil {
+		return frame, err
+	}
+	if maxBuckets := timeRange.Duration() / interval; maxBuckets > MAX_FILL_BUCKETS {
+		return frame, fmt.Errorf("unable to fill missing buckets, %d buckets exceeds the limit of %d", maxBuckets, MAX_FILL_BUCKETS)
+	}
+
+	// Group the existing rows into series, keeping the series in order of first appearance
+	type series struct {
+		labels  []interface{}
+		buckets map[int64]int // bucket time (nanos) -> row index
+	}
+	var seriesOrder []string
+	seriesByKey := map[string]*series{}
+	var unbucketedRows []int // rows with no time, or a time that's not on a bucket boundary
+	for row := 0; row < rowCount; row++ {
+		labels := make([]interface{}, len(labelIdxs))
+		for i, idx := range labelIdxs {
+			labels[i] = frame.Fields[idx].At(row)
+		}
+		key := fmt.Sprintf("%v", derefAll(labels))
+		s := seriesByKey[key]
+		if s == nil {
+			s = &series{labels: labels, buckets: map[int64]int{}}
+			seriesByKey[key] = s
+			seriesOrder = append(seriesOrder, key)
+		}
+		t, ok := frame.Fields[timeIdx].ConcreteAt(row)
+		if !ok || !bucketStart(t.(time.Time), interval).Equal(t.(time.Time)) {
+			unbucketedRows = append(unbucketedRows, row)
+			continue
+		}
+		s.buckets[t.(time.Time).UnixNano()] = row
+	}
+	if len(seriesOrder) == 0 {
+		// No results at all, so there's a single series with no labels
+		seriesOrder = append(seriesOrder, "")
+		seriesByKey[""] = &series{labels: make([]interface{}, len(labelIdxs)), buckets: map[int64]int{}}
+	}
+
+	filled := data.NewFrame(frame.Name)
+	filled.RefID = frame.RefID
+	filled.Meta = frame.Meta
+	for _, field := range frame.Fields {
+		newField := data.NewFieldFromFieldType(field.Type().NullableType(), 0)
+		newField.Name = field.Name
+		newField.Labels = field.Labels
+		newField.Config = field.Config
+		filled.Fields = append(filled.Fields, newField)
+	}
+	appendRow := func(vals []interface{}) {
+		for idx, val := range vals {
+			filled.Fields[idx].Append(val)
+		}
+	}
+	copyRow := func(row int) []interface{} {
+		vals := make([]interface{}, len(frame.Fields))
+		for idx, field := range frame.Fields {
+			if v, ok := field.ConcreteAt(row); ok {
+				vals[idx] = toPointer(v)
+			}
+		}
+		return vals
+	}
+
+	previous := map[string][]interface{}{} // series key -> last row of values seen
+	for t := bucketStart(timeRange.From, interval); !t.After(timeRange.To); t = t.Add(interval) {
+		for _, key := range seriesOrder {
+			s := seriesByKey[key]
+			if row, ok := s.buckets[t.UnixNano()]; ok {
+				vals := copyRow(row)
+				appendRow(vals)
+				previous[key] = vals
+				continue
+			}
+			vals := make([]interface{}, len(frame.Fields))
+			vals[timeIdx] = toPointer(t)
+			for i, idx := range labelIdxs {
+				vals[idx] = toPointer(s.labels[i])
+			}
+			for _, idx := range numberIdxs {
+				switch fillMode {
+				case FILL_MODE_ZERO:
+					vals[idx] = zeroPointer(filled.Fields[idx].Type())
+				case FILL_MODE_PREVIOUS:
+					if prev, ok := previous[key]; ok {
+						vals[idx] = prev[idx]
+					}
+				}
+			}
+			appendRow(vals)
+		}
+	}
+
+	// Buckets outside the time range, or rows which weren't aligned to a bucket, are kept as-is
+	for _, key := range seriesOrder {
+		for bucket, row := range seriesByKey[key].buckets {
+			if t := time.Unix(0, bucket); t.Before(bucketStart(timeRange.From, interval)) || t.After(timeRange.To) {
+				unbucketedRows = append(unbucketedRows, row)
+			}
+		}
+	}
+	for _, row := range unbucketedRows {
+		appendRow(copyRow(row))
+	}
+	if len(unbucketedRows) > 0 {
+		sortFrameByTime(filled, timeIdx)
+	}
+	return filled, nil
+}
+
+// Dereference any pointers, so values can be compared regardless of nullability
+func derefAll(vals []interface{}) []interface{} {
+	out := make([]interface{}, len(vals))
+	for i, val := range vals {
+		switch v := val.(type) {
+		case *string:
+			if v != nil {
+				out[i] = *v
+			}
+		case *bool:
+			if v != nil {
+				out[i] = *v
+			}
+		default:
+			out[i] = v
+		}
+	}
+	return out
+}
+
+// Convert a concrete value (or pointer) to the pointer form expected by nullable fields
+func toPointer(val interface{}) interface{} {
+	switch v := val.(type) {
+	case float64:
+		return &v
+	case string:
+		return &v
+	case bool:
+		return &v
+	case time.Time:
+		return &v
+	case int64:
+		return &v
+	default:
+		return v // already a pointer, or nil
+	}
+}
+
+// A pointer to the zero value for a nullable numeric field type
+func zeroPointer(fieldType data.FieldType) interface{} {
+	switch fieldType {
+	case data.FieldTypeNullableInt64:
+		v := int64(0)
+		return &v
+	default:
+		v := float64(0)
+		return &v
+	}
+}
+
+// Stable sort of the frame's rows by the time field, with any rows lacking a time at the end
+func sortFrameByTime(frame *data.Frame, timeIdx int) {
+	rowCount, _ := frame.RowLen()
+	rows := make([][]interface{}, rowCount)
+	for row := 0; row < rowCount; row++ {
+		rows[row] = frame.RowCopy(row)
+	}
+	timeOf := func(row []interface{}) (time.Time, bool) {
+		if t, ok := row[timeIdx].(*time.Time); ok && t != nil {
+			return *t, true
+		}
+		return time.Time{}, false
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		ta, okA := timeOf(rows[i])
+		tb, okB := timeOf(rows[j])
+		if okA && okB {
+			return ta.Before(tb)
+		}
+		return okA && !okB
+	})
+	for row, vals := range rows {
+		frame.SetRow(row, vals...)
+	}
+}
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKqlTimespan(t *testing.T) {
+	for _, test := range []struct {
+		In       string
+		Expected time.Duration
+	}{
+		{In: "500ms", Expected: 500 * time.Millisecond},
+		{In: "30s", Expected: 30 * time.Second},
+		{In: "5m", Expected: 5 * time.Minute},
+		{In: " 1h ", Expected: time.Hour},
+		{In: "1.5h", Expected: 90 * time.Minute},
+		{In: "1d", Expected: 24 * time.Hour},
+		{In: "5", Expected: 0},
+		{In: "5y", Expected: 0},
+		{In: "0m", Expected: 0},
+		{In: "", Expected: 0},
+	} {
+		out, err := parseKqlTimespan(test.In)
+		if test.Expected == 0 {
+			assert.NotNil(t, err, test.In)
+		} else {
+			assert.Nil(t, err, test.In)
+			assert.Equal(t, test.Expected, out, test.In)
+		}
+	}
+}
+
+func TestResolveFillInterval(t *testing.T) {
+	interval, err := resolveFillInterval("", `dataset="foo" | summarize count() by bin(_time, 5m), host`)
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Minute, interval)
+
+	interval, err = resolveFillInterval("1h", `dataset="foo" | summarize count() by bin(_time, 5m)`)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, interval, "explicit interval wins")
+
+	_, err = resolveFillInterval("", `dataset="foo" | limit 10`)
+	assert.NotNil(t, err, "no interval and no bin()")
+}
+
+func TestFillMissingBuckets(t *testing.T) {
+	base := time.Unix(1728744600, 0).UTC() // on a 5m boundary
+	timeRange := backend.TimeRange{From: base, To: base.Add(20 * time.Minute)}
+	makeFrame := func() *data.Frame {
+		return data.NewFrame("results",
+			data.NewField(GRAFANA_TIME_FIELD_NAME, nil, []time.Time{base, base.Add(15 * time.Minute)}),
+			data.NewField("count", nil, []float64{3, 7}),
+		)
+	}
+	counts := func(frame *data.Frame) []interface{} {
+		var out []interface{}
+		_, idx := frame.FieldByName("count")
+		for i := 0; i < frame.Fields[idx].Len(); i++ {
+			if v, ok := frame.Fields[idx].ConcreteAt(i); ok {
+				out = append(out, v)
+			} else {
+				out = append(out, nil)
+			}
+		}
+		return out
+	}
+
+	filled, err := fillMissingBuckets(makeFrame(), FILL_MODE_NULL, 5*time.Minute, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{3.0, nil, nil, 7.0, nil}, counts(filled))
+	assert.Equal(t, base.Add(5*time.Minute), *filled.Fields[0].At(1).(*time.Time))
+
+	filled, err = fillMissingBuckets(makeFrame(), FILL_MODE_ZERO, 5*time.Minute, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{3.0, 0.0, 0.0, 7.0, 0.0}, counts(filled))
+
+	filled, err = fillMissingBuckets(makeFrame(), FILL_MODE_PREVIOUS, 5*time.Minute, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{3.0, 3.0, 3.0, 7.0, 7.0}, counts(filled))
+
+	same, err := fillMissingBuckets(makeFrame(), FILL_MODE_NONE, 5*time.Minute, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, same.Fields[0].Len(), "none leaves the frame alone")
+
+	_, err = fillMissingBuckets(makeFrame(), "bogus", 5*time.Minute, timeRange)
+	assert.NotNil(t, err)
+}
+
+func TestFillMissingBucketsPerSeries(t *testing.T) {
+	base := time.Unix(1728744600, 0).UTC()
+	timeRange := backend.TimeRange{From: base, To: base.Add(10 * time.Minute)}
+	frame := data.NewFrame("results",
+		data.NewField(GRAFANA_TIME_FIELD_NAME, nil, []time.Time{base, base, base.Add(10 * time.Minute)}),
+		data.NewField("host", nil, []string{"a", "b", "a"}),
+		data.NewField("count", nil, []float64{1, 2, 3}),
+	)
+
+	filled, err := fillMissingBuckets(frame, FILL_MODE_ZERO, 5*time.Minute, timeRange)
+	assert.Nil(t, err)
+	rowCount, _ := filled.RowLen()
+	assert.Equal(t, 6, rowCount, "3 buckets x 2 series")
+
+	var hostB []float64
+	for row := 0; row < rowCount; row++ {
+		if *filled.Fields[1].At(row).(*string) == "b" {
+			hostB = append(hostB, *filled.Fields[2].At(row).(*float64))
+		}
+	}
+	assert.Equal(t, []float64{2, 0, 0}, hostB)
+}
+
+func TestFillMissingBucketsNoResults(t *testing.T) {
+	base := time.Unix(1728744600, 0).UTC()
+	frame := data.NewFrame("results",
+		data.NewField(GRAFANA_TIME_FIELD_NAME, nil, []time.Time{}),
+		data.NewField("count", nil, []float64{}),
+	)
+	filled, err := fillMissingBuckets(frame, FILL_MODE_ZERO, time.Minute, backend.TimeRange{From: base, To: base.Add(2 * time.Minute)})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, filled.Fields[0].Len())
+}
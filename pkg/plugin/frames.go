@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Builds a frame from Cribl result events, one row per event, establishing fields as they're encountered
+type frameBuilder struct {
+	frame      *data.Frame
+	timeFields map[string]bool // names of fields to convert to time values
+	eventCount int             // # of events (rows) added so far
+}
+
+func newFrameBuilder(frame *data.Frame, timeFields map[string]bool) *frameBuilder {
+	return &frameBuilder{frame: frame, timeFields: timeFields}
+}
+
+// Add an event to the frame
+func (fb *frameBuilder) addEvent(event map[string]interface{}) {
+	frame := fb.frame
+	// Grab the keys and values from the event and populate fields in the frame
+	for fieldName, value := range event {
+		if fb.timeFields[fieldName] {
+			// Two things are happening here:
+			// 1. Instead of our "_time" we use Grafana's well-known "time" field name.  Other time fields keep their name.
+			// 2. Convert from epoch/RFC3339 to time.Time struct.  If the conversion fails, the value must be something
+			// other than a time, and it will pass-through as is with the original field name.
+			if ok, time := criblTimeToGrafanaTime(value); ok {
+				if fieldName == CRIBL_TIME_FIELD {
+					fieldName = GRAFANA_TIME_FIELD_NAME
+				}
+				value = time
+			}
+		}
+
+		// Grafana doesn't like nested objects.  Convert it to a string as needed
+		value = flattenNestedObjectToString(value)
+
+		// Establish the field if it we haven't seen it yet
+		field, fieldIdx := frame.FieldByName(fieldName)
+		if fieldIdx == -1 {
+			arr, err := makeEmptyConcreteTypeArray(value)
+			if err != nil {
+				backend.Logger.Warn("unable to add field", "fieldName", fieldName, "reason", err.Error())
+				continue
+			}
+			field = data.NewField(fieldName, nil, arr)
+
+			if fb.eventCount > 0 {
+				field.Extend(fb.eventCount)
+			}
+
+			backend.Logger.Debug("adding field", "fieldName", fieldName)
+			frame.Fields = append(frame.Fields, field)
+		} else {
+			// Pad the rows of earlier events that lacked this field, so the value lands on this event's row
+			if field.Len() < fb.eventCount {
+				field.Extend(fb.eventCount - field.Len())
+			}
+			if field.Type() != data.FieldTypeFor(value) {
+				// i.e. a time field that failed to parse for this event, appending it would panic.  Append a
+				// zero value instead, so later values stay on their own rows.
+				backend.Logger.Warn("skipping value of unexpected type", "fieldName", fieldName, "type", fmt.Sprintf("%T", value))
+				field.Extend(1)
+				continue
+			}
+		}
+		field.Append(value)
+
+		// Track min/max if it's a number field
+		switch f := value.(type) {
+		case float64:
+			cf := data.ConfFloat64(f)
+			if field.Config == nil {
+				field.Config = &data.FieldConfig{Min: &cf, Max: &cf}
+			} else {
+				if cf < *field.Config.Min {
+					field.Config.Min = &cf
+				}
+				if cf > *field.Config.Max {
+					field.Config.Max = &cf
+				}
+			}
+		}
+	}
+
+	fb.eventCount++
+}
+
+// Finish building the frame once all events have been added.
+//
+// Grafana is strict about every field needing to have the same length (# of values).
+// If a field appeared in only some events, it may be missing values for later events.
+// Apparently sparse data causes problems for some reason.  Whatever, Grafana.  So we
+// must "extend" any sparse fields to the full length (lame, Grafana, lame).
+func (fb *frameBuilder) finish() {
+	for _, field := range fb.frame.Fields {
+		if field.Len() < fb.eventCount {
+			backend.Logger.Debug("extending field length", "fieldName", field.Name, "len", field.Len())
+			field.Extend(fb.eventCount - field.Len())
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameBuilderKeepsRowsAligned(t *testing.T) {
+	fb := newFrameBuilder(data.NewFrame("results"), map[string]bool{CRIBL_TIME_FIELD: true})
+	fb.addEvent(map[string]interface{}{"_time": 1728744000.0, "n": 1.0, "host": "a"})
+	fb.addEvent(map[string]interface{}{"_time": "bogus", "n": 2.0}) // an unparseable time, and no host
+	fb.addEvent(map[string]interface{}{"_time": 1728744002.0, "n": 3.0, "host": "c"})
+	fb.finish()
+
+	timeField, _ := fb.frame.FieldByName(GRAFANA_TIME_FIELD_NAME)
+	n, _ := fb.frame.FieldByName("n")
+	host, _ := fb.frame.FieldByName("host")
+	rawTime, _ := fb.frame.FieldByName(CRIBL_TIME_FIELD)
+	for _, field := range fb.frame.Fields {
+		assert.Equal(t, 3, field.Len(), field.Name)
+	}
+	assert.Equal(t, []float64{1, 2, 3}, []float64{n.At(0).(float64), n.At(1).(float64), n.At(2).(float64)})
+	assert.Equal(t, time.Unix(1728744000, 0).UTC(), timeField.At(0).(time.Time).UTC())
+	assert.True(t, timeField.At(1).(time.Time).IsZero(), "the event with a bad time has no time")
+	assert.Equal(t, time.Unix(1728744002, 0).UTC(), timeField.At(2).(time.Time).UTC(), "later times stay on their own rows")
+	assert.Equal(t, "bogus", rawTime.At(1))
+	assert.Equal(t, []string{"a", "", "c"}, []string{host.At(0).(string), host.At(1).(string), host.At(2).(string)})
+}
+
+func TestFrameBuilderSkipsValueOfUnexpectedType(t *testing.T) {
+	fb := newFrameBuilder(data.NewFrame("results"), nil)
+	fb.addEvent(map[string]interface{}{"n": 1.0})
+	fb.addEvent(map[string]interface{}{"n": "two"})
+	fb.addEvent(map[string]interface{}{"n": 3.0})
+	fb.finish()
+	n, _ := fb.frame.FieldByName("n")
+	assert.Equal(t, 3, n.Len())
+	assert.Equal(t, 0.0, n.At(1))
+	assert.Equal(t, 3.0, n.At(2), "the value after the skipped one stays on its row")
+}
@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const MAX_INCREMENTAL_QUERIES = 100 // # of queries whose previous results are retained for incremental refresh
+
+// The previous results of incremental queries, so a refresh only needs to query the new time window.
+// The zero value is ready to use.
+type incrementalStore struct {
+	mu      sync.Mutex
+	results map[string]*incrementalResult
+}
+
+// The raw events previously produced by an incremental query, and the window they cover
+type incrementalResult struct {
+	events    []map[string]interface{} // ordered by _time, never modified once stored
+	interval  time.Duration            // bin size of the query
+	from      time.Time
+	to        time.Time
+	updatedAt time.Time
+}
+
+func (s *incrementalStore) get(key string) *incrementalResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.results[key]
+}
+
+// Store the results for a key, evicting the least recently updated if there are too many
+func (s *incrementalStore) put(key string, result *incrementalResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.results == nil {
+		s.results = map[string]*incrementalResult{}
+	}
+	s.results[key] = result
+	for len(s.results) > MAX_INCREMENTAL_QUERIES {
+		oldestKey := ""
+		for k, r := range s.results {
+			if oldestKey == "" || r.updatedAt.Before(s.results[oldestKey].updatedAt) {
+				oldestKey = k
+			}
+		}
+		delete(s.results, oldestKey)
+	}
+}
+
+// Run a summarized (binned) time series query incrementally.  If we have the previous results of the
+// same query, with the same bin size, covering the start of the time range, only the window from the
+// last complete bucket up to now is queried.  New buckets are merged with the previous ones, and
+// buckets before the start of the time range are trimmed.  Otherwise it falls back to a full query.
+// Either way, the resulting events are added to the builder (in time order) and retained for next time.
+func (d *Datasource) queryIncremental(ctx context.Context, criblQuery *models.CriblQuery, preparedQuery string, timeout time.Duration, interval time.Duration, timeRange backend.TimeRange, builder *frameBuilder, meta *CriblFrameMeta) error {
+	key := queryKey(d.Settings.CriblOrgBaseUrl, url.Values{"query": {preparedQuery}}, criblQuery, builder.timeFields, 0)
+	now := time.Now()
+
+	windowFrom := timeRange.From
+	var kept []map[string]interface{}
+	if previous := d.incremental.get(key); previous != nil && previous.interval == interval {
+		// The bucket in progress when we last queried is incomplete, so it's queried again
+		lastComplete := bucketStart(previous.to, interval)
+		if !previous.from.After(timeRange.From) && !lastComplete.Before(timeRange.From) && !lastComplete.After(timeRange.To) {
+			windowFrom = lastComplete
+			kept = trimBuckets(previous.events, builder.timeFields, bucketStart(timeRange.From, interval), windowFrom)
+			meta.IncrementalFrom = &windowFrom
+			backend.Logger.Debug("incremental refresh", "windowFrom", windowFrom, "keptEvents", len(kept))
+		}
+	}
+
+	events, err := d.runChunk(ctx, preparedQuery, timeout, queryChunk{From: windowFrom, To: timeRange.To})
+	if err != nil {
+		return err
+	}
+	merged, _ := mergeChunkEvents([][]map[string]interface{}{kept, events}, builder.timeFields)
+	for _, event := range merged {
+		builder.addEvent(event)
+		resultsCounter.WithLabelValues(criblQuery.Type).Inc()
+	}
+
+	// Results we can't place in time, or which may have been truncated, can't be safely merged next time
+	if len(events) < MAX_RESULTS && len(merged) < MAX_RESULTS && allEventsTimed(merged, builder.timeFields) {
+		d.incremental.put(key, &incrementalResult{events: merged, interval: interval, from: timeRange.From, to: timeRange.To, updatedAt: now})
+	}
+	return nil
+}
+
+// Keep the events whose time (per the time fields, see mergeChunkEvents) is within [from, to)
+func trimBuckets(events []map[string]interface{}, timeFields map[string]bool, from time.Time, to time.Time) []map[string]interface{} {
+	names := orderedTimeFields(timeFields)
+	var kept []map[string]interface{}
+	for _, event := range events {
+		if ok, t := eventTime(event, names); ok && !t.Before(from) && t.Before(to) {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+func allEventsTimed(events []map[string]interface{}, timeFields map[string]bool) bool {
+	names := orderedTimeFields(timeFields)
+	for _, event := range events {
+		if ok, _ := eventTime(event, names); !ok {
+			return false
+		}
+	}
+	return true
+}
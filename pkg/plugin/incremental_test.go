@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryIncremental(t *testing.T) {
+	base := time.Unix(1728744600, 0).UTC() // on a 5m boundary
+	interval := 5 * time.Minute
+
+	// Produce a 5m bucket for each bin within the requested window, tagged with the request #
+	var earliests []string
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		earliests = append(earliests, params.Get("earliest"))
+		earliest, _ := strconv.ParseFloat(params.Get("earliest"), 64)
+		latest, _ := strconv.ParseFloat(params.Get("latest"), 64)
+		var events []string
+		for bucket := bucketStart(time.Unix(int64(earliest), 0), interval); bucket.Unix() < int64(latest); bucket = bucket.Add(interval) {
+			events = append(events, fmt.Sprintf(`{"_time":%d,"request":%d}`, bucket.Unix(), len(earliests)))
+		}
+		w.Write([]byte(fmt.Sprintf(`{"isFinished":true,"totalEventCount":%d,"job":{"id":"j1","status":"completed"}}`, len(events)) + "\n" + strings.Join(events, "\n")))
+	})
+	run := func(query string, from time.Time, to time.Time) backend.DataResponse {
+		json := fmt.Sprintf(`{"type":"adhoc","query":%q,"incremental":true}`, query)
+		return ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", TimeRange: backend.TimeRange{From: from, To: to}, JSON: []byte(json)})
+	}
+	query := `dataset="foo" | summarize count() by bin(_time, 5m)`
+
+	// Nothing to go on the first time, so the whole range is queried
+	res := run(query, base, base.Add(time.Hour))
+	assert.Nil(t, res.Error)
+	assert.Equal(t, formatCriblTime(base), earliests[0])
+	assert.Equal(t, 12, res.Frames[0].Rows())
+
+	// The range moved forward 10m, only the last (incomplete) bucket onward is queried
+	res = run(query, base.Add(10*time.Minute), base.Add(70*time.Minute))
+	assert.Nil(t, res.Error)
+	assert.Equal(t, formatCriblTime(base.Add(time.Hour)), earliests[1])
+	frame := res.Frames[0]
+	assert.Equal(t, 12, frame.Rows())
+	timeField, _ := frame.FieldByName(GRAFANA_TIME_FIELD_NAME)
+	requestField, _ := frame.FieldByName("request")
+	assert.Equal(t, base.Add(10*time.Minute), timeField.At(0), "buckets before the range are trimmed")
+	assert.Equal(t, float64(1), requestField.At(0), "retained from the previous refresh")
+	assert.Equal(t, float64(2), requestField.At(10), "re-queried")
+	assert.Equal(t, base.Add(time.Hour), frame.Meta.Custom.(*CriblFrameMeta).IncrementalFrom.UTC())
+
+	// A different bin size is a different query, so the whole range is queried again
+	run(strings.Replace(query, "5m", "1m", 1), base.Add(10*time.Minute), base.Add(70*time.Minute))
+	assert.Equal(t, formatCriblTime(base.Add(10*time.Minute)), earliests[2])
+
+	// So is going back in time
+	run(query, base, base.Add(time.Hour))
+	assert.Equal(t, formatCriblTime(base), earliests[3])
+
+	// Incremental refresh needs a bin size
+	res = run(`dataset="foo" | limit 10`, base, base.Add(time.Hour))
+	assert.NotNil(t, res.Error)
+}
+
+func TestQueryIncrementalCustomTimeField(t *testing.T) {
+	base := time.Unix(1728744600, 0).UTC() // on a 5m boundary
+	interval := 5 * time.Minute
+
+	// The bins are in a column other than _time
+	var earliests []string
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		earliests = append(earliests, params.Get("earliest"))
+		earliest, _ := strconv.ParseFloat(params.Get("earliest"), 64)
+		latest, _ := strconv.ParseFloat(params.Get("latest"), 64)
+		var events []string
+		for bucket := bucketStart(time.Unix(int64(earliest), 0), interval); bucket.Unix() < int64(latest); bucket = bucket.Add(interval) {
+			events = append(events, fmt.Sprintf(`{"ts":%d,"request":%d}`, bucket.Unix(), len(earliests)))
+		}
+		w.Write([]byte(fmt.Sprintf(`{"isFinished":true,"totalEventCount":%d,"job":{"id":"j1","status":"completed"}}`, len(events)) + "\n" + strings.Join(events, "\n")))
+	})
+	run := func(from time.Time, to time.Time) backend.DataResponse {
+		json := `{"type":"adhoc","query":"dataset=\"foo\" | summarize count() by ts=bin(_time, 5m)","incremental":true,"timeFields":["ts"]}`
+		return ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", TimeRange: backend.TimeRange{From: from, To: to}, JSON: []byte(json)})
+	}
+
+	res := run(base, base.Add(time.Hour))
+	assert.Nil(t, res.Error)
+	assert.Equal(t, 12, res.Frames[0].Rows())
+
+	res = run(base.Add(10*time.Minute), base.Add(70*time.Minute))
+	assert.Nil(t, res.Error)
+	assert.Equal(t, formatCriblTime(base.Add(time.Hour)), earliests[1], "only the last bucket onward is queried")
+	assert.Equal(t, 12, res.Frames[0].Rows(), "buckets before the range are trimmed by ts")
+	requestField, _ := res.Frames[0].FieldByName("request")
+	assert.Equal(t, float64(1), requestField.At(0), "retained from the previous refresh")
+}
+
+func TestIncrementalStoreEviction(t *testing.T) {
+	var store incrementalStore
+	now := time.Now()
+	for i := 0; i <= MAX_INCREMENTAL_QUERIES; i++ {
+		store.put(strconv.Itoa(i), &incrementalResult{updatedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+	assert.Len(t, store.results, MAX_INCREMENTAL_QUERIES)
+	assert.Nil(t, store.get("0"), "least recently updated is evicted")
+	assert.NotNil(t, store.get("1"))
+}
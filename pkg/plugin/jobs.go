@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// List the search job history as a table, filtered by status, user and the query's time range
+func (d *Datasource) queryJobs(criblQuery *models.CriblQuery, dataQuery backend.DataQuery) backend.DataResponse {
+	jobs, err := d.loadJobs(criblQuery, dataQuery.TimeRange)
+	if err != nil {
+		backend.Logger.Debug("loading jobs failed", "err", err)
+		return errorResponse(err)
+	}
+
+	var response backend.DataResponse
+	frame := buildJobsFrame(jobs, time.Now())
+	frame.RefID = dataQuery.RefID
+	response.Frames = append(response.Frames, frame)
+	resultsCounter.WithLabelValues(criblQuery.Type).Add(float64(frame.Fields[0].Len()))
+	return response
+}
+
+// Load the jobs matching the query's status & user (if any) created within the time range.  The filters
+// are sent to Cribl, and the history is fetched a page at a time until MAX_RESULTS jobs match or
+// MAX_RESULTS jobs have been scanned.  Jobs are filtered here too, in case Cribl ignores any filter.
+func (d *Datasource) loadJobs(criblQuery *models.CriblQuery, timeRange backend.TimeRange) ([]SearchJob, error) {
+	filters := url.Values{}
+	if status := strings.TrimSpace(criblQuery.JobsStatus); len(status) > 0 {
+		filters.Set("status", strings.ToLower(status))
+	}
+	if user := strings.TrimSpace(criblQuery.JobsUser); len(user) > 0 {
+		filters.Set("user", user)
+	}
+	filters.Set("earliest", formatCriblTime(timeRange.From))
+	filters.Set("latest", formatCriblTime(timeRange.To))
+
+	var jobs []SearchJob
+	for offset := 0; offset < MAX_RESULTS && len(jobs) < MAX_RESULTS; offset += QUERY_PAGE_SIZE {
+		page, err := d.SearchAPI.LoadJobs(filters, offset, QUERY_PAGE_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, filterJobs(page, criblQuery, timeRange)...)
+		if len(page) < QUERY_PAGE_SIZE {
+			break // that was the last page
+		}
+	}
+	return jobs[:min(len(jobs), MAX_RESULTS)], nil
+}
+
+// Filter jobs to those created within the time range, and matching the query's status & user (if any).
+// At most MAX_RESULTS jobs are returned.
+func filterJobs(jobs []SearchJob, criblQuery *models.CriblQuery, timeRange backend.TimeRange) []SearchJob {
+	status := strings.TrimSpace(criblQuery.JobsStatus)
+	user := strings.TrimSpace(criblQuery.JobsUser)
+	var filtered []SearchJob
+	for _, job := range jobs {
+		created := time.UnixMilli(int64(job.TimeCreated))
+		if created.Before(timeRange.From) || created.After(timeRange.To) {
+			continue
+		}
+		if len(status) > 0 && !strings.EqualFold(job.Status, status) {
+			continue
+		}
+		if len(user) > 0 && job.User != user {
+			continue
+		}
+		filtered = append(filtered, job)
+		if len(filtered) >= MAX_RESULTS {
+			break
+		}
+	}
+	return filtered
+}
+
+// Build a typed frame from a list of jobs.  Start/completion times and duration are null when not
+// yet known.  Jobs which are still running have their duration measured up to now.
+func buildJobsFrame(jobs []SearchJob, now time.Time) *data.Frame {
+	var (
+		created       []time.Time
+		ids, queries  []string
+		users, states []string
+		started       []*time.Time
+		completed     []*time.Time
+		durations     []*float64
+		scanned       []float64
+		fromGrafana   []bool
+	)
+	for _, job := range jobs {
+		created = append(created, time.UnixMilli(int64(job.TimeCreated)).UTC())
+		ids = append(ids, job.Id)
+		queries = append(queries, job.Query)
+		users = append(users, job.User)
+		states = append(states, job.Status)
+		scanned = append(scanned, job.EventsScanned)
+		fromGrafana = append(fromGrafana, strings.Contains(job.Query, GRAFANA_BREADCRUMB))
+
+		var startedAt, completedAt *time.Time
+		var duration *float64
+		if job.TimeStarted > 0 {
+			t := time.UnixMilli(int64(job.TimeStarted)).UTC()
+			startedAt = &t
+			end := now
+			if job.TimeCompleted > 0 {
+				c := time.UnixMilli(int64(job.TimeCompleted)).UTC()
+				completedAt = &c
+				end = c
+			}
+			ms := float64(end.Sub(t).Milliseconds())
+			duration = &ms
+		}
+		started = append(started, startedAt)
+		completed = append(completed, completedAt)
+		durations = append(durations, duration)
+	}
+
+	durationField := data.NewField("duration", nil, durations)
+	durationField.Config = &data.FieldConfig{Unit: "ms"}
+	frame := data.NewFrame("jobs",
+		data.NewField(GRAFANA_TIME_FIELD_NAME, nil, created),
+		data.NewField("id", nil, ids),
+		data.NewField("user", nil, users),
+		data.NewField("status", nil, states),
+		data.NewField("query", nil, queries),
+		data.NewField("started", nil, started),
+		data.NewField("completed", nil, completed),
+		durationField,
+		data.NewField("eventsScanned", nil, scanned),
+		data.NewField("fromGrafana", nil, fromGrafana),
+	)
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTable}
+	return frame
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterJobs(t *testing.T) {
+	base := time.UnixMilli(1728744793000)
+	jobs := []SearchJob{
+		{Id: "old", User: "alice", Status: "completed", TimeCreated: float64(base.Add(-time.Hour).UnixMilli())},
+		{Id: "a", User: "alice", Status: "completed", TimeCreated: float64(base.UnixMilli())},
+		{Id: "b", User: "bob", Status: "running", TimeCreated: float64(base.Add(time.Minute).UnixMilli())},
+		{Id: "c", User: "bob", Status: "completed", TimeCreated: float64(base.Add(2 * time.Minute).UnixMilli())},
+	}
+	timeRange := backend.TimeRange{From: base, To: base.Add(10 * time.Minute)}
+	ids := func(jobs []SearchJob) []string {
+		var out []string
+		for _, job := range jobs {
+			out = append(out, job.Id)
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"a", "b", "c"}, ids(filterJobs(jobs, &models.CriblQuery{}, timeRange)))
+	assert.Equal(t, []string{"a", "c"}, ids(filterJobs(jobs, &models.CriblQuery{JobsStatus: "Completed"}, timeRange)))
+	assert.Equal(t, []string{"b", "c"}, ids(filterJobs(jobs, &models.CriblQuery{JobsUser: "bob"}, timeRange)))
+	assert.Equal(t, []string{"b"}, ids(filterJobs(jobs, &models.CriblQuery{JobsUser: "bob", JobsStatus: "running"}, timeRange)))
+}
+
+func TestQueryJobsFiltersAndPages(t *testing.T) {
+	base := time.UnixMilli(1728744793000)
+	var offsets []string
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/m/default_search/search/jobs", r.URL.Path)
+		params := r.URL.Query()
+		assert.Equal(t, "running", params.Get("status"))
+		assert.Equal(t, "bob", params.Get("user"))
+		assert.Equal(t, formatCriblTime(base), params.Get("earliest"))
+		assert.Equal(t, formatCriblTime(base.Add(time.Hour)), params.Get("latest"))
+		assert.Equal(t, strconv.Itoa(QUERY_PAGE_SIZE), params.Get("limit"))
+		offsets = append(offsets, params.Get("offset"))
+		count := QUERY_PAGE_SIZE
+		if params.Get("offset") != "0" {
+			count = 3 // a short page is the last
+		}
+		var items []SearchJob
+		for i := 0; i < count; i++ {
+			items = append(items, SearchJob{Id: strconv.Itoa(i), User: "bob", Status: "running", TimeCreated: float64(base.UnixMilli())})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	})
+
+	res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID:     "A",
+		TimeRange: backend.TimeRange{From: base, To: base.Add(time.Hour)},
+		JSON:      []byte(`{"type":"jobs","jobsStatus":"Running","jobsUser":"bob"}`),
+	})
+	assert.Nil(t, res.Error)
+	assert.Equal(t, []string{"0", strconv.Itoa(QUERY_PAGE_SIZE)}, offsets)
+	assert.Equal(t, QUERY_PAGE_SIZE+3, res.Frames[0].Fields[0].Len())
+}
+
+func TestQueryJobsScansAtMostMaxResults(t *testing.T) {
+	requests := 0
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		items := make([]SearchJob, QUERY_PAGE_SIZE) // none of them created within the time range
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	})
+	now := time.Now()
+	res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID:     "A",
+		TimeRange: backend.TimeRange{From: now.Add(-time.Hour), To: now},
+		JSON:      []byte(`{"type":"jobs"}`),
+	})
+	assert.Nil(t, res.Error)
+	assert.Equal(t, 0, res.Frames[0].Fields[0].Len())
+	assert.Equal(t, MAX_RESULTS/QUERY_PAGE_SIZE, requests)
+}
+
+func TestBuildJobsFrame(t *testing.T) {
+	base := time.UnixMilli(1728744793000)
+	frame := buildJobsFrame([]SearchJob{
+		{
+			Id:            "done",
+			Query:         "dataset=\"foo\"\n// Grafana plugin",
+			Status:        "completed",
+			TimeCreated:   float64(base.UnixMilli()),
+			TimeStarted:   float64(base.Add(time.Second).UnixMilli()),
+			TimeCompleted: float64(base.Add(3 * time.Second).UnixMilli()),
+			EventsScanned: 42,
+		},
+		{
+			Id:          "queued",
+			Query:       "dataset=\"foo\"",
+			Status:      "queued",
+			TimeCreated: float64(base.UnixMilli()),
+		},
+	}, base.Add(time.Minute))
+
+	rowCount, err := frame.RowLen()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, rowCount)
+
+	_, durationIdx := frame.FieldByName("duration")
+	assert.Equal(t, 2000.0, *frame.Fields[durationIdx].At(0).(*float64))
+	assert.Nil(t, frame.Fields[durationIdx].At(1).(*float64), "not started, no duration")
+
+	_, grafanaIdx := frame.FieldByName("fromGrafana")
+	assert.Equal(t, true, frame.Fields[grafanaIdx].At(0))
+	assert.Equal(t, false, frame.Fields[grafanaIdx].At(1))
+}
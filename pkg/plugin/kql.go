@@ -0,0 +1,271 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+var kqlIdentifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Quote a field name for use in a Kusto query.  Plain identifiers are used as-is, anything
+// else (i.e. names with dots, dashes or spaces) uses the bracketed ['name'] form.
+func kqlFieldName(name string) string {
+	if kqlIdentifierRegex.MatchString(name) {
+		return name
+	}
+	return fmt.Sprintf("['%s']", kqlEscape(name, '\''))
+}
+
+// Quote a value as a Kusto string literal
+func kqlString(value string) string {
+	return fmt.Sprintf(`"%s"`, kqlEscape(value, '"'))
+}
+
+// Escape backslashes, the quote character, and any control characters that would break a literal
+func kqlEscape(s string, quote rune) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\':
+			sb.WriteString(`\\`)
+		case quote:
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Build a Kusto "where" predicate from a single Grafana ad hoc filter
+func adhocFilterToPredicate(filter models.AdhocFilter) (string, error) {
+	field := kqlFieldName(filter.Key)
+	switch filter.Operator {
+	case "=":
+		return fmt.Sprintf("%s == %s", field, kqlString(filter.Value)), nil
+	case "!=":
+		return fmt.Sprintf("%s != %s", field, kqlString(filter.Value)), nil
+	case "=~":
+		return fmt.Sprintf("%s matches regex %s", field, kqlString(filter.Value)), nil
+	case "!~":
+		return fmt.Sprintf("not(%s matches regex %s)", field, kqlString(filter.Value)), nil
+	case "<", ">":
+		// Compare numerically when the value looks like a number, otherwise fall back to a string comparison
+		if _, err := strconv.ParseFloat(filter.Value, 64); err == nil {
+			return fmt.Sprintf("%s %s %s", field, filter.Operator, filter.Value), nil
+		}
+		return fmt.Sprintf("%s %s %s", field, filter.Operator, kqlString(filter.Value)), nil
+	default:
+		return "", fmt.Errorf("unsupported ad hoc filter operator: %v", filter.Operator)
+	}
+}
+
+// Append a "| where" clause to the query for each of the supplied Grafana ad hoc filters.
+// Filters with an empty key are ignored.
+func applyAdhocFilters(query string, filters []models.AdhocFilter) (string, error) {
+	for _, filter := range filters {
+		if len(strings.TrimSpace(filter.Key)) == 0 {
+			continue
+		}
+		predicate, err := adhocFilterToPredicate(filter)
+		if err != nil {
+			return "", err
+		}
+		query = fmt.Sprintf("%s\n| where %s", query, predicate)
+	}
+	return query, nil
+}
+
+// Where a syntax error is in the query as the user wrote it, before it was collapsed onto one line
+type QueryErrorLocation struct {
+	Line   int `json:"line"`             // 1-based
+	Column int `json:"column"`           // 1-based, in characters
+	Length int `json:"length,omitempty"` // of the offending token, if known
+}
+
+// An error Cribl reported at a position within the prepared query
+type positionedError struct {
+	err    error
+	offset int // 0-based, in characters
+	length int
+}
+
+func (e *positionedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *positionedError) Unwrap() error {
+	return e.err
+}
+
+// Find the position of an error within the prepared query among the extra fields of a serialized
+// JavaScript error.  Cribl may give either a 0-based offset (and maybe the end), or a 1-based line
+// and column.  Since the prepared query is all on the first line, only that line can be mapped.
+func errorPosition(fields map[string]interface{}) (offset int, length int, ok bool) {
+	number := func(keys ...string) (int, bool) {
+		for _, key := range keys {
+			if n, ok := fields[key].(float64); ok && n >= 0 {
+				return int(n), true
+			}
+		}
+		return 0, false
+	}
+	if offset, ok = number("offset", "position", "pos", "start"); ok {
+		if end, ok := number("end"); ok && end > offset {
+			length = end - offset
+		}
+	} else if line, hasLine := number("line"); hasLine && line == 1 {
+		column, hasColumn := number("column", "col")
+		if !hasColumn || column < 1 {
+			return 0, 0, false
+		}
+		offset, ok = column-1, true
+	}
+	if n, hasLength := number("length"); hasLength {
+		length = n
+	}
+	return offset, length, ok
+}
+
+// Map an offset within the prepared query back to a line and column of the query as the user wrote
+// it, replaying how prepareQuery normalized it.  Returns false if the offset is past the end of the
+// user's query, i.e. in an ad hoc filter or the breadcrumb.
+func originalErrorLocation(query string, offset int) (*QueryErrorLocation, bool) {
+	_, origins := normalizeKql(query)
+	if offset < 0 || offset >= len(origins) {
+		return nil, false
+	}
+	runes := []rune(query)
+	line, column := 1, 1
+	for _, r := range runes[:origins[offset]] {
+		if r == '\n' {
+			line, column = line+1, 1
+		} else if r != '\r' {
+			column++
+		}
+	}
+	return &QueryErrorLocation{Line: line, Column: column}, true
+}
+
+// Normalize a (possibly multi-line) query so it can safely run as a single line.  Line comments are
+// stripped, since once collapsed they'd comment out the rest of the query.  Each run of newlines, tabs
+// and comments outside of string literals becomes a single space.  String literals are left exactly
+// as written, even if they contain newlines or "//".  Also returns, for each character of the result,
+// the index of the character of the query it came from.
+func normalizeKql(query string) (string, []int) {
+	runes := []rune(query)
+	var normalized []rune
+	var origins []int
+	emit := func(r rune, origin int) {
+		normalized = append(normalized, r)
+		origins = append(origins, origin)
+	}
+	gap := -1 // where the pending run of whitespace & comments started, if any
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == '\r' || r == '\n' || r == '\t':
+			if gap < 0 {
+				gap = i
+			}
+			i++
+			continue
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			if gap < 0 {
+				gap = i
+			}
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			continue
+		}
+		if gap >= 0 {
+			emit(' ', gap)
+			gap = -1
+		}
+		end := kqlStringEnd(runes, i)
+		for ; i < end; i++ {
+			emit(runes[i], i)
+		}
+	}
+	if gap >= 0 {
+		emit(' ', gap)
+	}
+	return string(normalized), origins
+}
+
+// If a string literal starts at index i, the index just past its end (or the end of the query, if it's
+// unterminated).  Otherwise just past the character at i.  Handles "..." and '...' with backslash
+// escapes, verbatim @"..." and @'...' where a doubled quote is an escaped quote, and ```...```.
+func kqlStringEnd(runes []rune, i int) int {
+	hasPrefix := func(at int, prefix string) bool {
+		return strings.HasPrefix(string(runes[at:min(at+len(prefix), len(runes))]), prefix)
+	}
+	switch {
+	case hasPrefix(i, "```"):
+		for j := i + 3; j < len(runes); j++ {
+			if hasPrefix(j, "```") {
+				return j + 3
+			}
+		}
+	case runes[i] == '@' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\''):
+		quote := runes[i+1]
+		for j := i + 2; j < len(runes); j++ {
+			if runes[j] == quote {
+				if j+1 < len(runes) && runes[j+1] == quote {
+					j++ // doubled quote
+					continue
+				}
+				return j + 1
+			}
+		}
+	case runes[i] == '"' || runes[i] == '\'':
+		quote := runes[i]
+		for j := i + 1; j < len(runes); j++ {
+			if runes[j] == '\\' {
+				j++ // escaped character
+			} else if runes[j] == quote {
+				return j + 1
+			}
+		}
+	default:
+		return i + 1
+	}
+	return len(runes)
+}
+
+// Respond to a failed ad-hoc query.  If Cribl said where in the query it found an error, the location
+// (in terms of the query as the user wrote it) is included in the frame's metadata, so the query editor
+// can point it out.
+func queryErrorResponse(err error, criblQuery *models.CriblQuery, frame *data.Frame, meta *CriblFrameMeta) backend.DataResponse {
+	response := errorResponse(err)
+	var positioned *positionedError
+	if criblQuery.Type != "adhoc" || !errors.As(err, &positioned) {
+		return response
+	}
+	offset := positioned.offset
+	if meta.restrictionLength > 0 && offset >= meta.restrictionAt {
+		// Past (or within) the clause restricting the datasets, which the user didn't write
+		offset = max(offset-meta.restrictionLength, meta.restrictionAt)
+	}
+	if location, ok := originalErrorLocation(criblQuery.Query, offset); ok {
+		location.Length = positioned.length
+		meta.ErrorLocation = location
+		response.Frames = data.Frames{frame}
+	}
+	return response
+}
@@ -0,0 +1,171 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKqlFieldName(t *testing.T) {
+	assert.Equal(t, "host", kqlFieldName("host"))
+	assert.Equal(t, "_time", kqlFieldName("_time"))
+	assert.Equal(t, "['kubernetes.pod']", kqlFieldName("kubernetes.pod"))
+	assert.Equal(t, "['user-agent']", kqlFieldName("user-agent"))
+	assert.Equal(t, `['it\'s']`, kqlFieldName("it's"))
+}
+
+func TestKqlString(t *testing.T) {
+	assert.Equal(t, `"web01"`, kqlString("web01"))
+	assert.Equal(t, `"say \"hi\""`, kqlString(`say "hi"`))
+	assert.Equal(t, `"C:\\temp"`, kqlString(`C:\temp`))
+	assert.Equal(t, `"one\ntwo"`, kqlString("one\ntwo"))
+}
+
+func TestApplyAdhocFilters(t *testing.T) {
+	for _, test := range []struct {
+		Filter   models.AdhocFilter
+		Expected string
+	}{
+		{
+			Filter:   models.AdhocFilter{Key: "host", Operator: "=", Value: "web01"},
+			Expected: "q\n| where host == \"web01\"",
+		},
+		{
+			Filter:   models.AdhocFilter{Key: "host", Operator: "!=", Value: `we"b`},
+			Expected: "q\n| where host != \"we\\\"b\"",
+		},
+		{
+			Filter:   models.AdhocFilter{Key: "k8s.ns", Operator: "=~", Value: `^prod-\d+$`},
+			Expected: "q\n| where ['k8s.ns'] matches regex \"^prod-\\\\d+$\"",
+		},
+		{
+			Filter:   models.AdhocFilter{Key: "host", Operator: "!~", Value: "^web"},
+			Expected: "q\n| where not(host matches regex \"^web\")",
+		},
+		{
+			Filter:   models.AdhocFilter{Key: "status", Operator: ">", Value: "499"},
+			Expected: "q\n| where status > 499",
+		},
+		{
+			Filter:   models.AdhocFilter{Key: "level", Operator: "<", Value: "warn"},
+			Expected: "q\n| where level < \"warn\"",
+		},
+		{
+			Filter:   models.AdhocFilter{Key: " ", Operator: "=", Value: "ignored"},
+			Expected: "q",
+		},
+	} {
+		out, err := applyAdhocFilters("q", []models.AdhocFilter{test.Filter})
+		assert.Nil(t, err, test.Filter)
+		assert.Equal(t, test.Expected, out, test.Filter)
+	}
+
+	out, err := applyAdhocFilters("q", []models.AdhocFilter{
+		{Key: "a", Operator: "=", Value: "1"},
+		{Key: "b", Operator: "!=", Value: "2"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "q\n| where a == \"1\"\n| where b != \"2\"", out)
+
+	_, err = applyAdhocFilters("q", []models.AdhocFilter{{Key: "a", Operator: "<>", Value: "1"}})
+	assert.NotNil(t, err, "unsupported operator should fail")
+}
+
+func TestOriginalErrorLocation(t *testing.T) {
+	query := "dataset=\"foo\"\n\t| where x >\r\n| limit 10"
+	prepared := prepareQuery(query, nil)
+	for _, test := range []struct {
+		Token    string
+		Expected QueryErrorLocation
+	}{
+		{"dataset", QueryErrorLocation{Line: 1, Column: 1}},
+		{"where", QueryErrorLocation{Line: 2, Column: 4}},
+		{"limit", QueryErrorLocation{Line: 3, Column: 3}},
+	} {
+		location, ok := originalErrorLocation(query, len([]rune(prepared[:strings.Index(prepared, test.Token)])))
+		assert.True(t, ok, test.Token)
+		assert.Equal(t, test.Expected, *location, test.Token)
+	}
+
+	// The collapsed whitespace between lines maps to the end of the first line
+	location, ok := originalErrorLocation(query, strings.Index(prepared, "|")-1)
+	assert.True(t, ok)
+	assert.Equal(t, QueryErrorLocation{Line: 1, Column: 14}, *location)
+
+	// Past the end of the query is the breadcrumb
+	_, ok = originalErrorLocation(query, len(prepared)-1)
+	assert.False(t, ok)
+}
+
+func TestErrorPosition(t *testing.T) {
+	for _, test := range []struct {
+		In             string
+		ExpectedOffset int
+		ExpectedLength int
+		ExpectedOk     bool
+	}{
+		{`{"name":"ParseError","message":"bad","offset":12}`, 12, 0, true},
+		{`{"name":"ParseError","message":"bad","start":12,"end":15}`, 12, 3, true},
+		{`{"name":"ParseError","message":"bad","line":1,"column":5,"length":2}`, 4, 2, true},
+		{`{"name":"ParseError","message":"bad","line":2,"column":5}`, 0, 0, false},
+		{`{"name":"ParseError","message":"bad","code":42}`, 0, 0, false},
+	} {
+		err := parseJavaScriptError([]byte(test.In))
+		positioned, ok := err.(*positionedError)
+		assert.Equal(t, test.ExpectedOk, ok, test.In)
+		if ok {
+			assert.Equal(t, test.ExpectedOffset, positioned.offset, test.In)
+			assert.Equal(t, test.ExpectedLength, positioned.length, test.In)
+		}
+	}
+}
+
+func TestQueryErrorLocation(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		// Point at "limitt", the way it was sent: on one line
+		offset := strings.Index(r.URL.Query().Get("query"), "limitt")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"error","message":"{\"name\":\"ParseError\",\"message\":\"unexpected token\",\"offset\":` + strconv.Itoa(offset) + `,\"length\":6}"}`))
+	})
+	timeRange := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+	res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"adhoc","query":"dataset=\"foo\"\n| limitt 10"}`)})
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+	assert.Contains(t, res.Error.Error(), "ParseError: unexpected token")
+	assert.Len(t, res.Frames, 1)
+	assert.Equal(t, &QueryErrorLocation{Line: 2, Column: 3, Length: 6}, res.Frames[0].Meta.Custom.(*CriblFrameMeta).ErrorLocation)
+}
+
+func TestNormalizeKql(t *testing.T) {
+	for _, test := range []struct {
+		In       string
+		Expected string
+	}{
+		{"dataset=\"foo\"\n| limit 10", "dataset=\"foo\" | limit 10"},
+		{"dataset=\"foo\" // just foo\n| limit 10", "dataset=\"foo\"  | limit 10"},
+		{"dataset=\"foo\"\n// | where x > 1\n\t| limit 10", "dataset=\"foo\" | limit 10"},
+		{"dataset=\"foo\" | where url == \"http://example.com\"", "dataset=\"foo\" | where url == \"http://example.com\""},
+		{"dataset=\"foo\" | where msg == 'it\\'s // not a comment'\n| limit 1", "dataset=\"foo\" | where msg == 'it\\'s // not a comment' | limit 1"},
+		{`dataset="foo" | where path == @"C:\dir\ ""q"" // still a string"`, `dataset="foo" | where path == @"C:\dir\ ""q"" // still a string"`},
+		{"print x=```line 1\n// line 2```\n| limit 1", "print x=```line 1\n// line 2``` | limit 1"},
+		{"print x=\"unterminated // string", "print x=\"unterminated // string"},
+	} {
+		normalized, origins := normalizeKql(test.In)
+		assert.Equal(t, test.Expected, normalized, test.In)
+		assert.Len(t, origins, len([]rune(normalized)))
+	}
+}
+
+func TestOriginalErrorLocationWithComments(t *testing.T) {
+	query := "dataset=\"foo\" // the foo dataset\n// | where x > 1\n| limitt 10"
+	prepared := prepareQuery(query, nil)
+	location, ok := originalErrorLocation(query, strings.Index(prepared, "limitt"))
+	assert.True(t, ok)
+	assert.Equal(t, QueryErrorLocation{Line: 3, Column: 3}, *location)
+}
@@ -0,0 +1,324 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Grafana org roles, from least to most privileged
+var orgRoleRanks = map[string]int{"Viewer": 1, "Editor": 2, "Admin": 3}
+
+// Terms of a query which pick its datasets, i.e. dataset="foo", dataset == 'foo' or dataset in ("foo", "bar")
+var datasetTermRegexp = regexp.MustCompile(`\bdataset\s*(?:==?|\bin\b)\s*(\([^)]*\)|"[^"]*"|'[^']*'|[\w.*-]+)`)
+
+// Any comparison of the dataset field, including those not handled by datasetTermRegexp (i.e. dataset != "foo")
+var datasetComparisonRegexp = regexp.MustCompile(`\bdataset\s*(?:[!=<>~]|(?i:(?:in|has|hasprefix|hassuffix|contains|startswith|endswith|matches|like)(?:_cs)?)\b)`)
+
+// Whether the data source's policy lets the user run ad-hoc queries, by their role or login
+func (d *Datasource) canRunAdhoc(user *backend.User) bool {
+	if len(d.Settings.AdhocMinRole) == 0 && len(d.Settings.AdhocUsers) == 0 {
+		return true // no restrictions
+	}
+	if user == nil {
+		return false
+	}
+	if minRank, ok := orgRoleRanks[d.Settings.AdhocMinRole]; ok && orgRoleRanks[user.Role] >= minRank {
+		return true
+	}
+	for _, allowed := range d.Settings.AdhocUsers {
+		allowed = strings.TrimSpace(allowed)
+		if len(allowed) > 0 && (strings.EqualFold(allowed, user.Login) || strings.EqualFold(allowed, user.Email)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the data source's policy allows the user to run the query, returning a forbidden error if not.
+// Users who can't run ad-hoc queries are restricted to saved searches, since fetching an arbitrary job
+// or listing the job history could expose the results or text of anyone's query.
+func (d *Datasource) checkQueryPolicy(user *backend.User, criblQuery *models.CriblQuery) error {
+	switch criblQuery.Type {
+	case "saved":
+		if !isAllowedSavedSearch(d.Settings, criblQuery.SavedSearchId) {
+			return forbiddenError(fmt.Errorf("saved search %v isn't allowed by this data source", criblQuery.SavedSearchId))
+		}
+	case "adhoc":
+		if !d.canRunAdhoc(user) {
+			return forbiddenError(fmt.Errorf("you aren't allowed to run ad-hoc queries with this data source, only saved searches"))
+		}
+		return checkAllowedDatasets(d.allowedDatasets, criblQuery.Query)
+	case "job", "jobs":
+		if !d.canRunAdhoc(user) {
+			return forbiddenError(fmt.Errorf("you aren't allowed to run %v queries with this data source, only saved searches", criblQuery.Type))
+		}
+	}
+	return nil
+}
+
+// Check the data source's policy allows the user to run a query for a resource (i.e. sampling events to
+// offer as ad hoc filter values), writing a forbidden response if not
+func (d *Datasource) checkResourcePolicy(w http.ResponseWriter, user *backend.User, query string) bool {
+	err := d.checkQueryPolicy(user, &models.CriblQuery{Type: "adhoc", Query: query})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func isAllowedSavedSearch(settings *models.PluginSettings, savedSearchId string) bool {
+	return len(settings.AllowedSavedSearchIds) == 0 || slices.Contains(settings.AllowedSavedSearchIds, savedSearchId)
+}
+
+// Check every dataset an ad-hoc query searches is allowed, if the data source restricts them.  Datasets
+// are found by their terms in the query, so a query must pick its datasets with = or in, and any other
+// comparison of the dataset field (which could widen the search) is refused.  So are dataset terms
+// combined with "or" or negated with "not", i.e. dataset="foo" or true, since the query could then
+// search any dataset, and subsearches (union, join & lookup), which restrictDatasets can't restrict.
+// Besides this check, restrictDatasets limits the query to the allowed datasets.
+func checkAllowedDatasets(allowed []*regexp.Regexp, query string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	normalized, _ := normalizeKql(query)
+	normalized = bracketedNameRegexp.ReplaceAllString(normalized, "$1$2") // ['dataset'] is the dataset field too
+	masked, depths := kqlStructure(normalized)
+	inCode := func(match []int) bool { return masked[match[0]] == normalized[match[0]] } // not in a string literal
+	if subsearch := subsearchRegexp.FindIndex(masked); subsearch != nil {
+		return forbiddenError(fmt.Errorf("this data source restricts which datasets may be searched, so queries can't use %v", normalized[subsearch[0]:subsearch[1]]))
+	}
+	var terms [][]int
+	checked := map[int]bool{}
+	for _, term := range datasetTermRegexp.FindAllStringSubmatchIndex(normalized, -1) {
+		if inCode(term) {
+			terms = append(terms, term)
+			checked[term[0]] = true
+		}
+	}
+	for _, comparison := range datasetComparisonRegexp.FindAllStringIndex(normalized, -1) {
+		if inCode(comparison) && !checked[comparison[0]] {
+			return forbiddenError(fmt.Errorf("this data source restricts which datasets may be searched, so datasets must be picked with = or in: %v", normalized[comparison[0]:comparison[1]]))
+		}
+	}
+	if len(terms) == 0 {
+		return forbiddenError(fmt.Errorf(`this data source restricts which datasets may be searched, so the query must name its datasets, i.e. dataset="foo"`))
+	}
+	ors := orRegexp.FindAllStringIndex(string(masked), -1)
+	nots := notRegexp.FindAllStringIndex(string(masked), -1)
+	for _, term := range terms {
+		for _, operator := range ors {
+			if governs(masked, depths, operator[0], term[0]) {
+				return forbiddenError(fmt.Errorf("this data source restricts which datasets may be searched, so datasets can't be picked in combination with %v", normalized[operator[0]:operator[1]]))
+			}
+		}
+		for _, operator := range nots {
+			if negates(masked, depths, operator[1], term[0]) {
+				return forbiddenError(fmt.Errorf("this data source restricts which datasets may be searched, so datasets can't be picked with %v", normalized[operator[0]:operator[1]]))
+			}
+		}
+		for _, dataset := range datasetTermValues(normalized[term[2]:term[3]]) {
+			if !isAllowedDataset(allowed, dataset) {
+				return forbiddenError(fmt.Errorf("dataset %v isn't allowed by this data source", dataset))
+			}
+		}
+	}
+	return nil
+}
+
+// Logical operators which could widen a search beyond the datasets it names
+var orRegexp = regexp.MustCompile(`(?i)\bor\b`)
+var notRegexp = regexp.MustCompile(`(?i)\bnot\b`)
+
+// Operators which search more data, besides the query's own search
+var subsearchRegexp = regexp.MustCompile(`(?i)\b(?:union|join|lookup)\b`)
+
+// A field name quoted in brackets, i.e. ['dataset'] or ["dataset"]
+var bracketedNameRegexp = regexp.MustCompile(`\[\s*(?:'([^']*)'|"([^"]*)")\s*\]`)
+
+// The structure of a normalized query: the query with its string literals masked (so their contents
+// aren't mistaken for code), and the depth of parentheses at each byte.  Parentheses themselves are at
+// the depth outside them.
+func kqlStructure(normalized string) ([]byte, []int) {
+	runes := []rune(normalized)
+	masked := make([]byte, 0, len(normalized))
+	depths := make([]int, 0, len(normalized))
+	depth := 0
+	for i := 0; i < len(runes); {
+		end := kqlStringEnd(runes, i)
+		if end > i+1 || runes[i] == '"' || runes[i] == '\'' {
+			for _, r := range runes[i:end] {
+				for range utf8.RuneLen(r) {
+					masked = append(masked, 'x')
+					depths = append(depths, depth)
+				}
+			}
+			i = end
+			continue
+		}
+		r := runes[i]
+		if r == ')' {
+			depth = max(depth-1, 0)
+		}
+		masked = utf8.AppendRune(masked, r)
+		for range utf8.RuneLen(r) {
+			depths = append(depths, depth)
+		}
+		if r == '(' {
+			depth++
+		}
+		i++
+	}
+	return masked, depths
+}
+
+// Whether a logical operator (at byte offset operator) applies to a term: they're within the same
+// parentheses (or the term is nested further within the operator's), and the same statement or stage of
+// the pipeline
+func governs(masked []byte, depths []int, operator int, term int) bool {
+	depth := depths[operator]
+	if depths[term] < depth {
+		return false
+	}
+	for i := min(operator, term); i < max(operator, term); i++ {
+		if depths[i] < depth || depths[i] == depth && (masked[i] == '|' || masked[i] == ';') {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a "not" (ending at byte offset operator) negates a term: the term follows it directly, or is
+// within the parentheses following it
+func negates(masked []byte, depths []int, operator int, term int) bool {
+	i := operator
+	for i < len(masked) && (masked[i] == ' ' || masked[i] == '\t' || masked[i] == '\n') {
+		i++
+	}
+	if i == term {
+		return true
+	}
+	if i >= len(masked) || masked[i] != '(' || term < i {
+		return false
+	}
+	for j := i + 1; j < term; j++ {
+		if depths[j] <= depths[i] {
+			return false // the parentheses closed before the term
+		}
+	}
+	return true
+}
+
+// Restrict an ad-hoc query to the allowed datasets, if the data source restricts them, by inserting a
+// "where" clause after the search clause of its main statement.  Returns the (normalized) query, along
+// with where the clause was inserted and its length, in characters, so positions of errors in the
+// prepared query can be mapped back to the query as written.
+func restrictDatasets(settings *models.PluginSettings, query string) (string, int, int) {
+	condition := allowedDatasetsCondition(settings.AllowedDatasets)
+	if len(condition) == 0 {
+		return query, 0, 0
+	}
+	normalized, _ := normalizeKql(query)
+	runes := []rune(normalized)
+	mainStart, pipe, depth := 0, -1, 0
+	for i := 0; i < len(runes); i = kqlStringEnd(runes, i) {
+		switch {
+		case runes[i] == '(':
+			depth++
+		case runes[i] == ')':
+			depth = max(depth-1, 0)
+		case depth == 0 && runes[i] == ';':
+			mainStart, pipe = i+1, -1
+		case depth == 0 && runes[i] == '|' && pipe < 0:
+			pipe = i
+		}
+	}
+	if pipe < 0 || pipe < mainStart {
+		clause := " | where " + condition
+		return normalized + clause, len(runes), len([]rune(clause))
+	}
+	clause := "| where " + condition + " "
+	return string(runes[:pipe]) + clause + string(runes[pipe:]), pipe, len([]rune(clause))
+}
+
+// The KQL condition matching the allowed datasets, i.e. dataset in ("foo", "bar") or dataset matches regex "^cribl_.*$"
+func allowedDatasetsCondition(allowed []string) string {
+	var names, conditions []string
+	for _, pattern := range allowed {
+		pattern = strings.TrimSpace(pattern)
+		switch {
+		case strings.ContainsAny(pattern, "*?"):
+			conditions = append(conditions, "dataset matches regex "+strconv.Quote(globRegexp(pattern)))
+		case len(pattern) > 0:
+			names = append(names, strconv.Quote(pattern))
+		}
+	}
+	if len(names) > 0 {
+		conditions = append([]string{"dataset in (" + strings.Join(names, ", ") + ")"}, conditions...)
+	}
+	return strings.Join(conditions, " or ")
+}
+
+// A regular expression matching names by a pattern where * matches any run of characters and ? any one
+func globRegexp(pattern string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
+
+// The dataset name(s) of a term's value: a quoted or bare name, or a parenthesized list of them
+func datasetTermValues(value string) []string {
+	if strings.HasPrefix(value, "(") {
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "("), ")")
+	}
+	var datasets []string
+	for _, dataset := range strings.Split(value, ",") {
+		dataset = strings.TrimSpace(dataset)
+		if len(dataset) >= 2 && (dataset[0] == '"' || dataset[0] == '\'') && dataset[len(dataset)-1] == dataset[0] {
+			dataset = dataset[1 : len(dataset)-1]
+		}
+		datasets = append(datasets, dataset)
+	}
+	return datasets
+}
+
+// Compile the allowed datasets, which may contain wildcards, or nil if any dataset is allowed
+func compileAllowedDatasets(patterns []string) []*regexp.Regexp {
+	var allowed []*regexp.Regexp
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); len(pattern) > 0 {
+			allowed = append(allowed, regexp.MustCompile(globRegexp(pattern)))
+		}
+	}
+	return allowed
+}
+
+// Whether a dataset is allowed.  A wildcard in the query's dataset only matches the same wildcard (or a
+// broader one), so "*" is only allowed if "*" is.
+func isAllowedDataset(allowed []*regexp.Regexp, dataset string) bool {
+	for _, pattern := range allowed {
+		if pattern.MatchString(dataset) {
+			return true
+		}
+	}
+	return false
+}
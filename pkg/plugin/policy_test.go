@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanRunAdhoc(t *testing.T) {
+	ds := &Datasource{Settings: &models.PluginSettings{}}
+	assert.True(t, ds.canRunAdhoc(nil), "anyone can when there are no restrictions")
+
+	ds.Settings.AdhocMinRole = "Editor"
+	ds.Settings.AdhocUsers = []string{"alice", " carol@example.com "}
+	for _, test := range []struct {
+		User     *backend.User
+		Expected bool
+	}{
+		{nil, false},
+		{&backend.User{Login: "bob", Role: "Viewer"}, false},
+		{&backend.User{Login: "bob", Role: "Editor"}, true},
+		{&backend.User{Login: "bob", Role: "Admin"}, true},
+		{&backend.User{Login: "bob", Role: "None"}, false},
+		{&backend.User{Login: "Alice", Role: "Viewer"}, true},
+		{&backend.User{Login: "carol", Email: "carol@example.com", Role: "Viewer"}, true},
+	} {
+		assert.Equal(t, test.Expected, ds.canRunAdhoc(test.User), "%+v", test.User)
+	}
+}
+
+func TestCheckQueryPolicy(t *testing.T) {
+	ds := &Datasource{Settings: &models.PluginSettings{AdhocMinRole: "Editor", AllowedSavedSearchIds: []string{"allowed"}}}
+	viewer := &backend.User{Login: "bob", Role: "Viewer"}
+	editor := &backend.User{Login: "bob", Role: "Editor"}
+	for _, test := range []struct {
+		User     *backend.User
+		Query    models.CriblQuery
+		Expected bool
+	}{
+		{viewer, models.CriblQuery{Type: "adhoc", Query: `dataset="foo"`}, false},
+		{editor, models.CriblQuery{Type: "adhoc", Query: `dataset="foo"`}, true},
+		{viewer, models.CriblQuery{Type: "job", JobId: "j1"}, false},
+		{viewer, models.CriblQuery{Type: "jobs"}, false},
+		{editor, models.CriblQuery{Type: "jobs"}, true},
+		{viewer, models.CriblQuery{Type: "saved", SavedSearchId: "allowed"}, true},
+		{viewer, models.CriblQuery{Type: "saved", SavedSearchId: "other"}, false},
+		{editor, models.CriblQuery{Type: "saved", SavedSearchId: "other"}, false},
+	} {
+		err := ds.checkQueryPolicy(test.User, &test.Query)
+		assert.Equal(t, test.Expected, err == nil, "%v %+v: %v", test.User.Role, test.Query, err)
+		if err != nil {
+			assert.Equal(t, backend.StatusForbidden, errorResponse(err).Status)
+		}
+	}
+}
+
+func TestCheckAllowedDatasets(t *testing.T) {
+	allowed := compileAllowedDatasets([]string{"foo", " cribl_*", ""})
+	for _, test := range []struct {
+		Query    string
+		Expected bool
+	}{
+		{`dataset="foo" | limit 10`, true},
+		{`dataset == 'foo'`, true},
+		{`dataset=cribl_logs | summarize count() by dataset`, true},
+		{`dataset in ("foo", "cribl_logs")`, true},
+		{`dataset="cribl_*"`, true},
+		{`dataset="bar"`, false},
+		{`dataset in ("foo", "bar")`, false},
+		{`dataset="*"`, false},
+		{`dataset="c*"`, false},
+		{`dataset != "foo"`, false},
+		{`dataset="foo" or dataset startswith "b"`, false},
+		{`dataset="foo" // dataset="bar"` + "\n| limit 10", true},
+		{`print 1`, false},
+		{`dataset="foo" or true`, false},
+		{`dataset="foo" or host="x"`, false},
+		{`host="x" or (dataset="foo")`, false},
+		{`not(dataset="foo")`, false},
+		{`dataset="foo" (status=500 or status=503)`, true},
+		{`dataset="foo" msg="this or that" | where a or b`, true},
+		{`dataset="foo" | join (dataset="cribl_logs" or true) on host`, false},
+		{`dataset="foo" | join (dataset="cribl_logs") on host`, false},
+		{`dataset="foo" | union (['dataset']=="secret")`, false},
+		{`dataset="foo" | lookup hosts on host`, false},
+		{`dataset="foo" msg="join us" | where join_key == 1`, true},
+		{`['dataset']=="foo"`, true},
+		{`["dataset"] == "bar"`, false},
+		{`dataset="foo" or ['dataset']=="bar"`, false},
+		{`['dataset'] != "foo"`, false},
+		{`dataset="foo" and not(isnull(x))`, true},
+		{`dataset="foo" not host="x"`, true},
+		{`not dataset="foo"`, false},
+		{`not (host="x" and dataset="foo")`, false},
+		{`not(host="x") and dataset="foo"`, true},
+	} {
+		err := checkAllowedDatasets(allowed, test.Query)
+		assert.Equal(t, test.Expected, err == nil, "%v: %v", test.Query, err)
+	}
+	assert.Nil(t, checkAllowedDatasets(nil, `print 1`), "any dataset when there's no allowlist")
+	assert.Nil(t, compileAllowedDatasets([]string{" ", ""}))
+
+	// The allowlist is compiled when the instance is created
+	ds, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: []byte(`{"allowedDatasets":["foo"]}`)})
+	assert.Nil(t, err)
+	defer ds.(*Datasource).Dispose()
+	assert.NotNil(t, ds.(*Datasource).checkQueryPolicy(nil, &models.CriblQuery{Type: "adhoc", Query: `dataset="bar"`}))
+}
+
+func TestQueryForbidden(t *testing.T) {
+	requests := 0
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"isFinished":true,"totalEventCount":0,"job":{"id":"j1","status":"completed"}}`))
+	})
+	ds.Settings.AdhocMinRole = "Admin"
+	timeRange := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+	pCtx := backend.PluginContext{User: &backend.User{Login: "bob", Role: "Editor"}}
+
+	res := ds.query(context.Background(), pCtx, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`)})
+	assert.Equal(t, backend.StatusForbidden, res.Status)
+	assert.Equal(t, backend.ErrorSourceDownstream, res.ErrorSource)
+	assert.Equal(t, 0, requests, "nothing is sent to Cribl")
+
+	res = ds.query(context.Background(), pCtx, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"type":"saved","savedSearchId":"my_search"}`)})
+	assert.Nil(t, res.Error)
+	assert.Equal(t, 1, requests)
+}
+
+func TestResourcePolicy(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items":[{"id":"allowed"},{"id":"other"}]}`))
+	})
+	ds.Settings.AdhocMinRole = "Editor"
+	ds.Settings.AllowedSavedSearchIds = []string{"allowed"}
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{User: &backend.User{Login: "bob", Role: "Viewer"}})
+
+	w := httptest.NewRecorder()
+	ds.handleTagKeys(w, httptest.NewRequest(http.MethodGet, "/tagKeys?query=dataset%3D%22foo%22", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusForbidden, w.Code, "sampling events is an ad-hoc query")
+
+	w = httptest.NewRecorder()
+	ds.handleSavedSearchIds(w, httptest.NewRequest(http.MethodGet, "/savedSearchIds", nil).WithContext(ctx))
+	var ids []string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ids))
+	assert.Equal(t, []string{"allowed"}, ids)
+}
+
+func TestRestrictDatasets(t *testing.T) {
+	settings := &models.PluginSettings{AllowedDatasets: []string{"foo", "cribl_*", "bar"}}
+	query, at, length := restrictDatasets(settings, "dataset=\"foo\"\n| summarize count() by host")
+	assert.Equal(t, `dataset="foo" | where dataset in ("foo", "bar") or dataset matches regex "^cribl_.*$" | summarize count() by host`, query)
+	assert.Equal(t, 14, at)
+	assert.Equal(t, len(`| where dataset in ("foo", "bar") or dataset matches regex "^cribl_.*$" `), length)
+
+	query, _, _ = restrictDatasets(settings, `let x = (dataset="foo" | limit 1); dataset="bar" msg="a|b"`)
+	assert.Equal(t, `let x = (dataset="foo" | limit 1); dataset="bar" msg="a|b" | where dataset in ("foo", "bar") or dataset matches regex "^cribl_.*$"`, query)
+
+	query, _, _ = restrictDatasets(&models.PluginSettings{}, `dataset="foo"`)
+	assert.Equal(t, `dataset="foo"`, query, "unchanged when there's no allowlist")
+
+	// The restriction is applied to the query sent to Cribl
+	ds := newTestDatasource(t, nil)
+	ds.Settings.AllowedDatasets = []string{"foo"}
+	params, _, err := ds.buildQueryParams(&models.CriblQuery{Type: "adhoc", Query: `dataset="foo" or true`}, backend.TimeRange{}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "dataset=\"foo\" or true | where dataset in (\"foo\")\n// Grafana plugin", params.Get("query"))
+}
+
+func TestErrorLocationAfterRestriction(t *testing.T) {
+	meta := &CriblFrameMeta{}
+	query := `dataset="foo" | bogus`
+	_, meta.restrictionAt, meta.restrictionLength = restrictDatasets(&models.PluginSettings{AllowedDatasets: []string{"foo"}}, query)
+	err := &positionedError{err: errors.New("unknown operator"), offset: meta.restrictionAt + meta.restrictionLength + 2, length: 5}
+	res := queryErrorResponse(err, &models.CriblQuery{Type: "adhoc", Query: query}, data.NewFrame("results"), meta)
+	assert.Equal(t, &QueryErrorLocation{Line: 1, Column: 17, Length: 5}, meta.ErrorLocation, "the position in the query as written")
+	assert.NotNil(t, res.Error)
+}
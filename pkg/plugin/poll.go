@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const DEFAULT_POLL_INITIAL_DELAY = 100 * time.Millisecond
+
+// Job statuses meaning the job won't make any more progress
+var finalJobStatuses = map[string]bool{"completed": true, "failed": true, "canceled": true}
+
+// When to poll a running job: Fibonacci backoff from an initial delay, capped at a max, with optional
+// random jitter so many queries started together don't poll in lockstep.
+type pollSchedule struct {
+	prev, delay time.Duration
+	max         time.Duration
+	jitter      float64 // +/- fraction of each delay, 0 to 1
+}
+
+// Create a poll schedule per the settings, defaulting to 100ms initial delay, MAX_BACKOFF_DURATION & no jitter
+func newPollSchedule(settings *models.PluginSettings) *pollSchedule {
+	schedule := &pollSchedule{delay: DEFAULT_POLL_INITIAL_DELAY, max: MAX_BACKOFF_DURATION}
+	if settings == nil {
+		return schedule
+	}
+	if settings.PollInitialDelaySec != nil && *settings.PollInitialDelaySec > 0 {
+		schedule.delay = time.Duration(*settings.PollInitialDelaySec * 1e9)
+	}
+	if settings.PollMaxBackoffSec != nil && *settings.PollMaxBackoffSec > 0 {
+		schedule.max = time.Duration(*settings.PollMaxBackoffSec * 1e9)
+	}
+	if settings.PollJitter != nil {
+		schedule.jitter = min(max(*settings.PollJitter, 0), 1)
+	}
+	return schedule
+}
+
+// How long to wait before the next poll
+func (s *pollSchedule) next() time.Duration {
+	delay := min(s.delay, s.max)
+	if s.prev == 0 {
+		s.prev = s.delay // i.e. 100ms, 200ms, 300ms, 500ms, ...
+	}
+	s.prev, s.delay = s.delay, s.prev+s.delay
+	if s.jitter > 0 {
+		delay += time.Duration(float64(delay) * s.jitter * (2*rand.Float64() - 1))
+	}
+	return delay
+}
+
+// Poll a job's status (without fetching results) per the schedule, until it's final.  Returns the final
+// status, or ctx's error if ctx is done first, along with the last status seen (if any).  The job isn't
+// canceled, that's up to the caller.
+func (api *SearchAPI) waitForJob(ctx context.Context, jobId string, schedule *pollSchedule) (string, error) {
+	lastStatus := ""
+	for {
+		delay := schedule.next()
+		backend.Logger.Debug("job not finished, delaying/backing off", "jobId", jobId, "delay", delay.String())
+		select {
+		case <-ctx.Done():
+			return lastStatus, ctx.Err()
+		case <-time.After(delay):
+		}
+		status, err := api.GetJobStatus(jobId)
+		if err != nil {
+			return lastStatus, err
+		}
+		lastStatus = status
+		if finalJobStatuses[status] {
+			return status, nil
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollSchedule(t *testing.T) {
+	schedule := newPollSchedule(nil)
+	var delays []time.Duration
+	for i := 0; i < 8; i++ {
+		delays = append(delays, schedule.next())
+	}
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{100 * ms, 200 * ms, 300 * ms, 500 * ms, 800 * ms, 1300 * ms, 2000 * ms, 2000 * ms}, delays)
+
+	initial, maxBackoff, jitter := 1.0, 3.0, 0.5
+	schedule = newPollSchedule(&models.PluginSettings{PollInitialDelaySec: &initial, PollMaxBackoffSec: &maxBackoff, PollJitter: &jitter})
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		delay := schedule.next()
+		assert.GreaterOrEqual(t, delay, expected/2)
+		assert.LessOrEqual(t, delay, expected*3/2)
+	}
+}
+
+func TestQueryPollsJobStatus(t *testing.T) {
+	// The job is running for the first two status polls, results are only fetched once it's completed
+	var mu sync.Mutex
+	var requests []string
+	statusPolls := 0
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.URL.Path+"?"+r.URL.Query().Get("jobId"))
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/jobs/j1/status"):
+			statusPolls++
+			if statusPolls < 3 {
+				w.Write([]byte(`{"items":[{"status":"running"}]}`))
+			} else {
+				w.Write([]byte(`{"items":[{"status":"completed"}]}`))
+			}
+		case r.URL.Query().Has("query"):
+			w.Write([]byte(`{"isFinished":false,"job":{"id":"j1","status":"running"}}`))
+		default:
+			w.Write([]byte(`{"isFinished":true,"totalEventCount":1,"job":{"id":"j1","status":"completed"}}` + "\n" + `{"_time":1728744793,"n":1}`))
+		}
+	})
+	initial := 0.001
+	ds.Settings.PollInitialDelaySec = &initial
+
+	res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID:     "A",
+		TimeRange: backend.TimeRange{From: time.Unix(1728744000, 0), To: time.Unix(1728747600, 0)},
+		JSON:      []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`),
+	})
+	assert.Nil(t, res.Error)
+	assert.Equal(t, 1, res.Frames[0].Rows())
+	assert.Equal(t, []string{
+		"/api/v1/m/default_search/search/query?",
+		"/api/v1/m/default_search/search/jobs/j1/status?",
+		"/api/v1/m/default_search/search/jobs/j1/status?",
+		"/api/v1/m/default_search/search/jobs/j1/status?",
+		"/api/v1/m/default_search/search/query?j1",
+	}, requests)
+}
+
+func TestWaitForJobCanceled(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items":[{"status":"running"}]}`))
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := ds.SearchAPI.waitForJob(ctx, "j1", newPollSchedule(nil))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -9,7 +10,10 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/criblcloud/search-datasource/pkg/models"
@@ -40,6 +44,11 @@ type SearchAPI struct {
 	Settings    *models.PluginSettings
 	BearerToken *BearerToken
 	httpClient  *http.Client
+
+	tokenMu sync.Mutex // guards BearerToken, since requests run concurrently (i.e. pages or chunks fetched at once)
+
+	jobsMu     sync.Mutex
+	activeJobs map[string]bool // IDs of jobs we started which haven't finished or been canceled
 }
 
 type SearchQueryResult struct {
@@ -64,7 +73,7 @@ func (api *SearchAPI) RunQueryAndGetResults(queryParams *url.Values) (*SearchQue
 		}
 		var event map[string]interface{}
 		if err := json.Unmarshal([]byte(line), &event); err != nil {
-			return nil, fmt.Errorf("failed to parse json at line %d: %s", idx+1, line)
+			return nil, badGatewayError(fmt.Errorf("failed to parse json at line %d: %s", idx+1, line))
 		}
 		if idx == 0 {
 			result.Header = event
@@ -72,28 +81,162 @@ func (api *SearchAPI) RunQueryAndGetResults(queryParams *url.Values) (*SearchQue
 			result.Events = append(result.Events, event)
 		}
 	}
+	api.trackJob(queryParams, result.Header)
 	return &result, nil
 }
 
+// Fetch the results of a finished job from offset start up to (not including) end, in pages of
+// QUERY_PAGE_SIZE, fetching up to MAX_PAGE_FETCHES pages at once.  The events are returned in order.
+// Should the job have fewer results than expected, we return what there is.
+func (api *SearchAPI) FetchPages(ctx context.Context, jobId string, start int, end int) ([]map[string]interface{}, error) {
+	var offsets []int
+	for offset := start; offset < end; offset += QUERY_PAGE_SIZE {
+		offsets = append(offsets, offset)
+	}
+	pages := make([][]map[string]interface{}, len(offsets))
+	errs := make([]error, len(offsets))
+	semaphore := make(chan struct{}, MAX_PAGE_FETCHES)
+	var wg sync.WaitGroup
+	for i, offset := range offsets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			pages[i], errs[i] = api.fetchPage(jobId, offset, min(offset+QUERY_PAGE_SIZE, end))
+		}()
+	}
+	wg.Wait()
+
+	var events []map[string]interface{}
+	for i, page := range pages {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		events = append(events, page...)
+		if len(page) < min(QUERY_PAGE_SIZE, end-offsets[i]) {
+			break // ran out of results, don't leave a gap
+		}
+	}
+	return events, nil
+}
+
+// Fetch the results of a finished job from offset start up to (not including) end.  If Cribl returns
+// fewer than asked for, keep asking for the rest until there's no more.
+func (api *SearchAPI) fetchPage(jobId string, start int, end int) ([]map[string]interface{}, error) {
+	var events []map[string]interface{}
+	for start+len(events) < end {
+		queryParams := url.Values{}
+		queryParams.Set("jobId", jobId)
+		queryParams.Set("offset", strconv.Itoa(start+len(events)))
+		queryParams.Set("limit", strconv.Itoa(end-start-len(events)))
+		result, err := api.RunQueryAndGetResults(&queryParams)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Events) == 0 {
+			break
+		}
+		events = append(events, result.Events...)
+	}
+	return events, nil
+}
+
+// Keep track of the jobs we start (by query or saved search ID) until they finish, so they can be canceled
+// if need be.  Existing jobs we merely fetch results from (by job ID) aren't ours, unless we started them.
+func (api *SearchAPI) trackJob(queryParams *url.Values, header map[string]interface{}) {
+	job, _ := header["job"].(map[string]interface{})
+	jobId, _ := job["id"].(string)
+	if len(jobId) == 0 {
+		return
+	}
+	isFinished, _ := header["isFinished"].(bool)
+	started := queryParams.Has("query") || queryParams.Has("queryId")
+
+	api.jobsMu.Lock()
+	defer api.jobsMu.Unlock()
+	if isFinished {
+		delete(api.activeJobs, jobId)
+	} else if started {
+		if api.activeJobs == nil {
+			api.activeJobs = map[string]bool{}
+		}
+		api.activeJobs[jobId] = true
+	}
+}
+
+// IDs of the jobs we started which haven't finished or been canceled
+func (api *SearchAPI) ActiveJobIds() []string {
+	api.jobsMu.Lock()
+	defer api.jobsMu.Unlock()
+	ids := make([]string, 0, len(api.activeJobs))
+	for id := range api.activeJobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 // Cancel a search query.
 func (api *SearchAPI) CancelQuery(jobId string) error {
+	api.jobsMu.Lock()
+	delete(api.activeJobs, jobId)
+	api.jobsMu.Unlock()
 	_, err := api.doPOST(fmt.Sprintf("/api/v1/m/default_search/search/jobs/%s/cancel", jobId), nil, "application/json", []byte("{}"))
 	return err
 }
 
+// Get the status of a job (i.e. "running" or "completed") without fetching any results, which is much
+// cheaper when polling a job until it finishes.  The response is expected to look like
+// {"items":[{"status":"running",...}]}.
+func (api *SearchAPI) GetJobStatus(jobId string) (string, error) {
+	responseBytes, err := api.doGET(fmt.Sprintf("/api/v1/m/default_search/search/jobs/%s/status", url.PathEscape(jobId)), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get status of job %s: %w", jobId, err)
+	}
+	var data struct {
+		Items []struct {
+			Status string `json:"status"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(responseBytes, &data); err != nil {
+		return "", badGatewayError(fmt.Errorf("failed to get status of job %s: error while parsing JSON: %v", jobId, err.Error()))
+	}
+	if len(data.Items) == 0 || len(data.Items[0].Status) == 0 {
+		return "", httpStatusError(http.StatusNotFound, fmt.Errorf("job %s not found", jobId))
+	}
+	return data.Items[0].Status, nil
+}
+
+// Cancel every job we started which hasn't finished, i.e. when shutting down
+func (api *SearchAPI) CancelActiveJobs() {
+	for _, jobId := range api.ActiveJobIds() {
+		if err := api.CancelQuery(jobId); err != nil {
+			backend.Logger.Warn("failed to cancel query", "jobId", jobId, "err", err)
+		} else {
+			backend.Logger.Info("query canceled", "jobId", jobId, "reason", "shutting down")
+		}
+	}
+}
+
 // Load the list of saved search IDs available to the user corresponding to the API creds.
 // This can be used to populate a dropdown to make it easy for the user to pick one.
 // Returns a list of saved search IDs.
 func (api *SearchAPI) LoadSavedSearchIds() ([]string, error) {
 	responseBytes, err := api.doGET("/api/v1/m/default_search/search/saved", nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load saved search ids: %v", err.Error())
+		return nil, fmt.Errorf("failed to load saved search ids: %w", err)
 	}
 	var data struct {
 		Items []map[string]any `json:"items"`
 	}
 	if err = json.Unmarshal(responseBytes, &data); err != nil {
-		return nil, fmt.Errorf("failed to load saved search ids: error while parsing JSON: %v", err.Error())
+		return nil, badGatewayError(fmt.Errorf("failed to load saved search ids: error while parsing JSON: %v", err.Error()))
 	}
 
 	var ids []string
@@ -103,6 +246,169 @@ func (api *SearchAPI) LoadSavedSearchIds() ([]string, error) {
 	return ids, nil
 }
 
+// A saved search, as defined in Cribl
+type SavedSearch struct {
+	Id       string      `json:"id"`
+	Query    string      `json:"query"`
+	Earliest interface{} `json:"earliest"` // relative expression (i.e. "-1h") or epoch seconds
+	Latest   interface{} `json:"latest"`
+}
+
+// The saved search's earliest & latest, formatted for use as query params
+func (s *SavedSearch) TimeRange() (string, string) {
+	format := func(v interface{}, fallback string) string {
+		switch t := v.(type) {
+		case string:
+			if len(t) > 0 {
+				return t
+			}
+		case float64:
+			return strconv.FormatFloat(t, 'f', -1, 64)
+		}
+		return fallback
+	}
+	return format(s.Earliest, "-1h"), format(s.Latest, "now")
+}
+
+// Load a saved search definition by ID
+func (api *SearchAPI) LoadSavedSearch(id string) (*SavedSearch, error) {
+	responseBytes, err := api.doGET(fmt.Sprintf("/api/v1/m/default_search/search/saved/%s", url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load saved search %s: %w", id, err)
+	}
+	var data struct {
+		Items []SavedSearch `json:"items"`
+	}
+	if err = json.Unmarshal(responseBytes, &data); err != nil {
+		return nil, badGatewayError(fmt.Errorf("failed to load saved search %s: error while parsing JSON: %v", id, err.Error()))
+	}
+	if len(data.Items) == 0 || len(strings.TrimSpace(data.Items[0].Query)) == 0 {
+		return nil, httpStatusError(http.StatusNotFound, fmt.Errorf("saved search %s not found or has no query", id))
+	}
+	return &data.Items[0], nil
+}
+
+// A search job, as listed in Cribl's job history
+type SearchJob struct {
+	Id            string  `json:"id"`
+	Query         string  `json:"query"`
+	User          string  `json:"user"`
+	Status        string  `json:"status"`
+	TimeCreated   float64 `json:"timeCreated"`   // epoch millis
+	TimeStarted   float64 `json:"timeStarted"`   // epoch millis, 0 if not started
+	TimeCompleted float64 `json:"timeCompleted"` // epoch millis, 0 if not completed
+	EventsScanned float64 `json:"eventsScanned"`
+}
+
+// Load a page of the search job history visible to the user corresponding to the API creds, filtered by
+// the given params (i.e. status, user, earliest & latest)
+func (api *SearchAPI) LoadJobs(filters url.Values, offset int, limit int) ([]SearchJob, error) {
+	queryParams := url.Values{}
+	for name, values := range filters {
+		queryParams[name] = values
+	}
+	queryParams.Set("offset", strconv.Itoa(offset))
+	queryParams.Set("limit", strconv.Itoa(limit))
+	responseBytes, err := api.doGET("/api/v1/m/default_search/search/jobs", &queryParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load search jobs: %w", err)
+	}
+	var data struct {
+		Items []SearchJob `json:"items"`
+	}
+	if err = json.Unmarshal(responseBytes, &data); err != nil {
+		return nil, badGatewayError(fmt.Errorf("failed to load search jobs: error while parsing JSON: %v", err.Error()))
+	}
+	return data.Items, nil
+}
+
+// Load the names of the fields found in a sample of the results of a query.  This is used to
+// offer real field names in Grafana's ad hoc filter UI.  Returns the field names, sorted.
+func (api *SearchAPI) LoadFieldNames(ctx context.Context, query string, earliest string, latest string) ([]string, error) {
+	queryParams := url.Values{}
+	queryParams.Set("query", prepareQuery(fmt.Sprintf("%s | limit %d", query, TAG_SAMPLE_SIZE), nil))
+	queryParams.Set("earliest", earliest)
+	queryParams.Set("latest", latest)
+	result, err := api.runQueryToCompletion(ctx, &queryParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load field names: %w", err)
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, event := range result.Events {
+		for name := range event {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Load the distinct values of a field in the results of a query.  This is used to offer real
+// values in Grafana's ad hoc filter UI.  Returns the values (as strings), sorted.
+func (api *SearchAPI) LoadFieldValues(ctx context.Context, query string, field string, earliest string, latest string) ([]string, error) {
+	queryParams := url.Values{}
+	queryParams.Set("query", prepareQuery(fmt.Sprintf("%s | summarize count() by %s | limit %d", query, kqlFieldName(field), TAG_SAMPLE_SIZE), nil))
+	queryParams.Set("earliest", earliest)
+	queryParams.Set("latest", latest)
+	result, err := api.runQueryToCompletion(ctx, &queryParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load values for field %s: %w", field, err)
+	}
+
+	values := []string{}
+	for _, event := range result.Events {
+		if value, ok := event[field]; ok && value != nil {
+			values = append(values, fmt.Sprint(flattenNestedObjectToString(value)))
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// Run a query and poll the job's status until it has finished, then return the first page of
+// results.  Intended for small, bounded queries such as those used to populate
+// the ad hoc filter UI, where we don't need paging.
+func (api *SearchAPI) runQueryToCompletion(ctx context.Context, queryParams *url.Values) (*SearchQueryResult, error) {
+	result, err := api.RunQueryAndGetResults(queryParams)
+	if err != nil {
+		return nil, err
+	}
+	job, _ := result.Header["job"].(map[string]interface{})
+	if job == nil || job["id"] == nil {
+		return nil, badGatewayError(errors.New("response header line has no job or job id"))
+	}
+	jobId := job["id"].(string)
+	if isFinished, _ := result.Header["isFinished"].(bool); !isFinished {
+		// Wait for the job to finish, then fetch its results
+		if _, err := api.waitForJob(ctx, jobId, newPollSchedule(api.Settings)); err != nil {
+			if ctx.Err() != nil {
+				if err := api.CancelQuery(jobId); err != nil {
+					backend.Logger.Warn("failed to cancel query", "jobId", jobId, "err", err)
+				}
+			}
+			return nil, err
+		}
+		resultParams := &url.Values{}
+		resultParams.Set("jobId", jobId)
+		if limit := queryParams.Get("limit"); len(limit) > 0 {
+			resultParams.Set("limit", limit)
+		}
+		if result, err = api.RunQueryAndGetResults(resultParams); err != nil {
+			return nil, err
+		}
+		job, _ = result.Header["job"].(map[string]interface{})
+	}
+	if status, _ := job["status"].(string); status != "completed" {
+		return nil, invalidQueryError(fmt.Errorf("job %s ended with status %s", jobId, status))
+	}
+	return result, nil
+}
+
 // Perform a GET request to the API, returning the raw response body as a byte array
 func (api *SearchAPI) doGET(uri string, queryParams *url.Values) ([]byte, error) {
 	req, err := http.NewRequest("GET", api.url(uri), nil)
@@ -111,7 +417,7 @@ func (api *SearchAPI) doGET(uri string, queryParams *url.Values) ([]byte, error)
 	}
 	err = api.addAuthorization(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to add Authorization: %v", err.Error())
+		return nil, fmt.Errorf("failed to add Authorization: %w", err)
 	}
 	if queryParams != nil {
 		req.URL.RawQuery = queryParams.Encode()
@@ -120,7 +426,7 @@ func (api *SearchAPI) doGET(uri string, queryParams *url.Values) ([]byte, error)
 	backend.Logger.Debug("http GET", "URL", req.URL.String())
 	res, err := api.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("GET request failed: %v", err.Error())
+		return nil, badGatewayError(fmt.Errorf("GET request failed: %v", err.Error()))
 	}
 	return api.readResponse(res)
 }
@@ -133,7 +439,7 @@ func (api *SearchAPI) doPOST(uri string, queryParams *url.Values, contentType st
 	}
 	err = api.addAuthorization(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to add Authorization: %v", err.Error())
+		return nil, fmt.Errorf("failed to add Authorization: %w", err)
 	}
 	if queryParams != nil {
 		req.URL.RawQuery = queryParams.Encode()
@@ -143,7 +449,7 @@ func (api *SearchAPI) doPOST(uri string, queryParams *url.Values, contentType st
 	backend.Logger.Debug("http POST", "URL", req.URL.String(), "contentType", contentType)
 	res, err := api.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("POST request failed: %v", err.Error())
+		return nil, badGatewayError(fmt.Errorf("POST request failed: %v", err.Error()))
 	}
 	return api.readResponse(res)
 }
@@ -152,15 +458,15 @@ func (api *SearchAPI) readResponse(res *http.Response) ([]byte, error) {
 	defer res.Body.Close()
 	responseBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err.Error())
+		return nil, badGatewayError(fmt.Errorf("failed to read response body: %v", err.Error()))
 	}
 	if res.StatusCode != http.StatusOK {
 		// Try to parse the error from the response
 		if err := parseErrorFromResponse(responseBody); err != nil {
-			return nil, err
+			return nil, httpStatusError(res.StatusCode, err)
 		}
 		// Couldn't parse the error from the response, just return a generalized error
-		return nil, fmt.Errorf("request failed (%v): %v", res.StatusCode, string(responseBody))
+		return nil, httpStatusError(res.StatusCode, fmt.Errorf("request failed (%v): %v", res.StatusCode, string(responseBody)))
 	}
 	return responseBody, nil
 }
@@ -172,17 +478,21 @@ func (api *SearchAPI) url(path string) string {
 
 // Add the Authorization header to an http.Request, refreshing our cached authentication as needed
 func (api *SearchAPI) addAuthorization(req *http.Request) error {
+	api.tokenMu.Lock()
 	err := api.refreshBearerTokenAsNeeded()
+	token := api.BearerToken
+	api.tokenMu.Unlock()
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", api.BearerToken.Token))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Token))
 	return nil
 }
 
 // Establish the cached bearer token, refreshing as needed.  This honors the expiration time
 // but applies a 30-second buffer to avoid cutting it too close.  Bearer tokens are typically
-// valid for many hours.
+// valid for many hours.  The caller must hold tokenMu, so concurrent requests wait for a single
+// refresh rather than each refreshing.
 func (api *SearchAPI) refreshBearerTokenAsNeeded() error {
 	if api.BearerToken != nil && api.BearerToken.ExpiresAt > (time.Now().UnixMilli()+30000) {
 		backend.Logger.Debug("Reusing cached bearer token", "ExpiresAt", api.BearerToken.ExpiresAt)
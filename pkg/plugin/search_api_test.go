@@ -1,9 +1,18 @@
 package plugin
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -67,3 +76,137 @@ func TestParseErrorFromResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestSavedSearchTimeRange(t *testing.T) {
+	earliest, latest := (&SavedSearch{Earliest: "-24h", Latest: "now"}).TimeRange()
+	assert.Equal(t, "-24h", earliest)
+	assert.Equal(t, "now", latest)
+
+	earliest, latest = (&SavedSearch{Earliest: float64(1728744793), Latest: float64(1728748393.5)}).TimeRange()
+	assert.Equal(t, "1728744793", earliest)
+	assert.Equal(t, "1728748393.5", latest)
+
+	earliest, latest = (&SavedSearch{}).TimeRange()
+	assert.Equal(t, "-1h", earliest, "defaults when not defined")
+	assert.Equal(t, "now", latest)
+}
+
+func TestTrackJob(t *testing.T) {
+	api := &SearchAPI{}
+	running := map[string]interface{}{"isFinished": false, "job": map[string]interface{}{"id": "j1"}}
+	finished := map[string]interface{}{"isFinished": true, "job": map[string]interface{}{"id": "j1"}}
+
+	api.trackJob(&url.Values{"jobId": {"j1"}}, running)
+	assert.Empty(t, api.ActiveJobIds(), "someone else's job")
+
+	api.trackJob(&url.Values{"query": {"dataset=\"foo\""}}, running)
+	assert.Equal(t, []string{"j1"}, api.ActiveJobIds())
+	api.trackJob(&url.Values{"jobId": {"j1"}}, running)
+	assert.Equal(t, []string{"j1"}, api.ActiveJobIds())
+	api.trackJob(&url.Values{"jobId": {"j1"}}, finished)
+	assert.Empty(t, api.ActiveJobIds())
+
+	api.trackJob(&url.Values{"queryId": {"my_search"}}, finished)
+	assert.Empty(t, api.ActiveJobIds(), "cached results, no job started")
+}
+
+func TestGetJobStatus(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/m/default_search/search/jobs/j1/status":
+			w.Write([]byte(`{"items":[{"status":"running"}],"count":1}`))
+		default:
+			w.Write([]byte(`{"items":[]}`))
+		}
+	})
+	status, err := ds.SearchAPI.GetJobStatus("j1")
+	assert.Nil(t, err)
+	assert.Equal(t, "running", status)
+	_, err = ds.SearchAPI.GetJobStatus("nope")
+	assert.NotNil(t, err)
+}
+
+// Serve a finished job with the given # of events ({"i":0}, {"i":1}, ...), returning at most maxPerResponse
+// events per request, and tracking how many requests were in flight at once
+func newPagingTestDatasource(t *testing.T, total int, maxPerResponse int) (*Datasource, *atomic.Int32) {
+	var inFlight, maxInFlight atomic.Int32
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond) // give concurrent requests a chance to overlap
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		lines := []string{fmt.Sprintf(`{"isFinished":true,"totalEventCount":%d,"job":{"id":"j1","status":"completed"}}`, total)}
+		for i := offset; i < min(offset+limit, offset+maxPerResponse, total); i++ {
+			lines = append(lines, fmt.Sprintf(`{"i":%d}`, i))
+		}
+		w.Write([]byte(strings.Join(lines, "\n")))
+	})
+	return ds, &maxInFlight
+}
+
+func TestFetchPages(t *testing.T) {
+	ds, maxInFlight := newPagingTestDatasource(t, 5500, 700)
+	events, err := ds.SearchAPI.FetchPages(context.Background(), "j1", 100, 5500)
+	assert.Nil(t, err)
+	assert.Len(t, events, 5400)
+	for idx, event := range events {
+		if event["i"] != float64(100+idx) {
+			t.Fatalf("event %d out of order: %v", idx, event)
+		}
+	}
+	assert.Greater(t, maxInFlight.Load(), int32(1), "pages fetched in parallel")
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(MAX_PAGE_FETCHES))
+
+	// Fewer results than expected
+	events, err = ds.SearchAPI.FetchPages(context.Background(), "j1", 5000, 8000)
+	assert.Nil(t, err)
+	assert.Len(t, events, 500)
+}
+
+func TestFetchPagesRefreshesTokenOnce(t *testing.T) {
+	var logins atomic.Int32
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("secret"))
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/auth/login" {
+			logins.Add(1)
+			time.Sleep(5 * time.Millisecond) // give concurrent page fetches a chance to pile up
+			w.Write([]byte(fmt.Sprintf(`{"token":%q}`, token)))
+			return
+		}
+		assert.Equal(t, "Bearer "+token, r.Header.Get("Authorization"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		lines := []string{`{"isFinished":true,"totalEventCount":5000,"job":{"id":"j1","status":"completed"}}`}
+		for i := offset; i < offset+limit; i++ {
+			lines = append(lines, fmt.Sprintf(`{"i":%d}`, i))
+		}
+		w.Write([]byte(strings.Join(lines, "\n")))
+	})
+	ds.SearchAPI.BearerToken = nil // the concurrent page fetches all need a token
+
+	events, err := ds.SearchAPI.FetchPages(context.Background(), "j1", 0, 5000)
+	assert.Nil(t, err)
+	assert.Len(t, events, 5000)
+	assert.Equal(t, int32(1), logins.Load(), "one refresh, shared by the page fetches")
+}
+
+func TestQueryFetchesPagesInParallel(t *testing.T) {
+	ds, maxInFlight := newPagingTestDatasource(t, 12000, QUERY_PAGE_SIZE)
+	res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID:     "A",
+		TimeRange: backend.TimeRange{From: time.Unix(1728744000, 0), To: time.Unix(1728747600, 0)},
+		JSON:      []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`),
+	})
+	assert.Nil(t, res.Error)
+	field, _ := res.Frames[0].FieldByName("i")
+	assert.Equal(t, MAX_RESULTS, field.Len())
+	assert.Equal(t, float64(MAX_RESULTS-1), field.At(MAX_RESULTS-1))
+	assert.Greater(t, maxInFlight.Load(), int32(1))
+}
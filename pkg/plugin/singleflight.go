@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Coalesces identical queries running at the same time (i.e. a dashboard loaded by many people at once),
+// so only one Cribl job runs and its results are shared by every caller.  The zero value is ready to use.
+type queryFlights struct {
+	mu      sync.Mutex
+	flights map[string]*queryFlight
+}
+
+// A query in flight, shared by its callers
+type queryFlight struct {
+	done     chan struct{} // closed once response is set
+	response backend.DataResponse
+	callers  int                // # of callers still waiting
+	cancel   context.CancelFunc // cancels the run, once every caller has gone away
+}
+
+// Run the query identified by key, or if an identical query is already running, wait for its response
+// instead.  The run gets its own context, which is only canceled once every caller's context is done,
+// so one impatient caller doesn't cancel the job out from under the others.  shared is true when the
+// response came from another caller's run, in which case the frames must not be modified.
+func (f *queryFlights) do(ctx context.Context, key string, run func(ctx context.Context) backend.DataResponse) (response backend.DataResponse, shared bool) {
+	f.mu.Lock()
+	if f.flights == nil {
+		f.flights = map[string]*queryFlight{}
+	}
+	flight, shared := f.flights[key]
+	if shared {
+		flight.callers++
+	} else {
+		runCtx, cancel := context.WithCancel(context.Background())
+		flight = &queryFlight{done: make(chan struct{}), callers: 1, cancel: cancel}
+		f.flights[key] = flight
+		go func() {
+			response := run(runCtx)
+			f.mu.Lock()
+			flight.response = response
+			if f.flights[key] == flight {
+				delete(f.flights, key)
+			}
+			f.mu.Unlock()
+			cancel()
+			close(flight.done)
+		}()
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-flight.done:
+		return flight.response, shared
+	case <-ctx.Done():
+		f.mu.Lock()
+		flight.callers--
+		if flight.callers == 0 {
+			// Nobody is left waiting, so cancel the run (and its job).  Later callers start afresh.
+			flight.cancel()
+			if f.flights[key] == flight {
+				delete(f.flights, key)
+			}
+		}
+		f.mu.Unlock()
+		return errorResponse(queryCanceledError()), shared
+	}
+}
+
+// Shallow copy a shared response's frames with the given RefID, leaving the original untouched
+func withRefID(response backend.DataResponse, refID string) backend.DataResponse {
+	frames := make(data.Frames, len(response.Frames))
+	for i, frame := range response.Frames {
+		copied := *frame
+		copied.RefID = refID
+		frames[i] = &copied
+	}
+	response.Frames = frames
+	return response
+}
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryFlightsShareResponse(t *testing.T) {
+	var flights queryFlights
+	var runs atomic.Int32
+	release := make(chan struct{})
+	run := func(ctx context.Context) backend.DataResponse {
+		runs.Add(1)
+		<-release
+		frame := data.NewFrame("results")
+		frame.RefID = "A"
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]backend.DataResponse, 5)
+	shared := make([]bool, 5)
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], shared[i] = flights.do(context.Background(), "key", run)
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		flights.mu.Lock()
+		defer flights.mu.Unlock()
+		return flights.flights["key"] != nil && flights.flights["key"].callers == 5
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), runs.Load())
+	sharedCount := 0
+	for i, response := range responses {
+		assert.Len(t, response.Frames, 1)
+		if shared[i] {
+			sharedCount++
+		}
+	}
+	assert.Equal(t, 4, sharedCount)
+	assert.Empty(t, flights.flights, "done flights are forgotten")
+
+	// With nothing in flight, the next caller runs the query again
+	flights.do(context.Background(), "key", run)
+	assert.Equal(t, int32(2), runs.Load())
+}
+
+func TestQueryFlightsCancelOnlyWhenAllCallersGone(t *testing.T) {
+	var flights queryFlights
+	canceled := make(chan struct{})
+	run := func(ctx context.Context) backend.DataResponse {
+		<-ctx.Done()
+		close(canceled)
+		return backend.ErrDataResponse(backend.StatusBadRequest, "Query Canceled")
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	ctxB, cancelB := context.WithCancel(context.Background())
+	doneA, doneB := make(chan backend.DataResponse), make(chan backend.DataResponse)
+	go func() { res, _ := flights.do(ctxA, "key", run); doneA <- res }()
+	assert.Eventually(t, func() bool {
+		flights.mu.Lock()
+		defer flights.mu.Unlock()
+		return flights.flights["key"] != nil
+	}, 5*time.Second, time.Millisecond)
+	go func() { res, _ := flights.do(ctxB, "key", run); doneB <- res }()
+	assert.Eventually(t, func() bool {
+		flights.mu.Lock()
+		defer flights.mu.Unlock()
+		return flights.flights["key"].callers == 2
+	}, 5*time.Second, time.Millisecond)
+
+	cancelA()
+	assert.NotNil(t, (<-doneA).Error)
+	select {
+	case <-canceled:
+		t.Fatal("run canceled while a caller is still waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelB()
+	assert.NotNil(t, (<-doneB).Error)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run not canceled once every caller had gone")
+	}
+}
+
+func TestWithRefID(t *testing.T) {
+	frame := data.NewFrame("results", data.NewField("n", nil, []float64{1}))
+	frame.RefID = "A"
+	response := withRefID(backend.DataResponse{Frames: data.Frames{frame}}, "B")
+	assert.Equal(t, "B", response.Frames[0].RefID)
+	assert.Equal(t, "A", frame.RefID, "the shared frame is untouched")
+	assert.Equal(t, 1, response.Frames[0].Rows())
+}
@@ -0,0 +1,435 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Grafana Live channel paths handled by RunStream, followed by a unique ID chosen by the frontend
+const STREAM_PATH_QUERY = "query/" // progressive results of a single query
+const STREAM_PATH_TAIL = "tail/"   // live tail of an ad-hoc query
+
+const DEFAULT_TAIL_INTERVAL = 5 * time.Second
+const MIN_TAIL_INTERVAL = time.Second
+const DEFAULT_TAIL_LOOKBACK = time.Minute // initial window when the subscriber doesn't supply a start time
+
+// Data supplied by the frontend when subscribing to a stream: the query plus its time range
+type streamQueryRequest struct {
+	models.CriblQuery
+	RefID string `json:"refId"`
+	From  int64  `json:"from"` // epoch millis
+	To    int64  `json:"to"`   // epoch millis
+
+	TailIntervalSec float64 `json:"tailIntervalSec,omitempty"` // for live tail, how often to poll for new events
+
+	crumb *breadcrumb // identifies the stream's jobs in the search job history
+}
+
+func (r *streamQueryRequest) TimeRange() backend.TimeRange {
+	return backend.TimeRange{From: time.UnixMilli(r.From), To: time.UnixMilli(r.To)}
+}
+
+// How often a live tail polls for new events
+func (r *streamQueryRequest) TailInterval() time.Duration {
+	if r.TailIntervalSec <= 0 {
+		return DEFAULT_TAIL_INTERVAL
+	}
+	return max(time.Duration(r.TailIntervalSec*float64(time.Second)), MIN_TAIL_INTERVAL)
+}
+
+// IDs the frontend chooses for streams, i.e. "Q123-A"
+var streamIdRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// A stream's channel path is bound to its query and the user it was issued to: "query/<id>/<signature>",
+// where the signature is a hash of the path's kind and ID, the user, and the query.  Anyone subscribing
+// to a channel joins the stream it's already running, so otherwise a user could guess the path of another
+// user's stream and receive its results.  The frontend gets the path from the streamPath resource.
+func streamChannelSignature(kindAndId string, pCtx backend.PluginContext, req *streamQueryRequest) string {
+	login := ""
+	if pCtx.User != nil {
+		login = pCtx.User.Login
+	}
+	canonical, _ := json.Marshal(req) // however the frontend happened to encode it
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%d\n%s\n", kindAndId, pCtx.OrgID, login)
+	hash.Write(canonical)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Check a stream's channel path was issued to the user for the query
+func checkStreamChannel(path string, pCtx backend.PluginContext, req *streamQueryRequest) error {
+	i := strings.LastIndex(path, "/")
+	if i < 0 || strings.Count(path, "/") != 2 || path[i+1:] != streamChannelSignature(path[:i], pCtx, req) {
+		return forbiddenError(errors.New("the stream's channel wasn't issued to you for this query"))
+	}
+	return nil
+}
+
+// Handle a request for the channel path of a stream, given the "kind" of stream ("query" or "tail"), an
+// "id" unique to the stream, and the "data" the frontend will subscribe with
+func (d *Datasource) handleStreamPath(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Kind string          `json:"kind"`
+		Id   string          `json:"id"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("failed to unmarshal stream path request: %v", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if !streamIdRegexp.MatchString(body.Id) {
+		http.Error(w, "stream ID is missing or invalid", http.StatusBadRequest)
+		return
+	}
+	kindAndId := body.Kind + "/" + body.Id
+	req, err := parseStreamQueryRequest(kindAndId+"/", body.Data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, _ := json.Marshal(map[string]string{"path": kindAndId + "/" + streamChannelSignature(kindAndId, backend.PluginConfigFromContext(r.Context()), req)})
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Parse and validate the data supplied when subscribing to a stream at the given path
+func parseStreamQueryRequest(path string, raw json.RawMessage) (*streamQueryRequest, error) {
+	var req streamQueryRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal stream request: %v", err.Error())
+	}
+	if err := canRunQuery(&req.CriblQuery); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(path, STREAM_PATH_QUERY):
+		if req.Type == "jobs" {
+			return nil, fmt.Errorf("query type %v can't be streamed", req.Type)
+		}
+	case strings.HasPrefix(path, STREAM_PATH_TAIL):
+		if req.Type != "adhoc" {
+			return nil, fmt.Errorf("query type %v can't be tailed, only adhoc", req.Type)
+		}
+	default:
+		return nil, fmt.Errorf("unknown stream path: %v", path)
+	}
+	return &req, nil
+}
+
+// SubscribeStream is called when a client wants to connect to a stream.  We only allow paths we know
+// how to run, with a query we're able to run, which the data source's policy allows the user to run, on
+// a channel issued to the user for that query.  Every subscriber is checked, since later subscribers join
+// the stream run for the first.
+func (d *Datasource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	streamReq, err := parseStreamQueryRequest(req.Path, req.Data)
+	if err != nil {
+		backend.Logger.Debug("rejecting stream subscription", "path", req.Path, "err", err)
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	if err := d.checkStreamAccess(req.Path, req.PluginContext, streamReq); err != nil {
+		backend.Logger.Info("stream subscription not allowed", "path", req.Path, "err", err)
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusPermissionDenied}, nil
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// Check the user may run the stream's query, on the stream's channel
+func (d *Datasource) checkStreamAccess(path string, pCtx backend.PluginContext, req *streamQueryRequest) error {
+	if err := checkStreamChannel(path, pCtx, req); err != nil {
+		return err
+	}
+	return d.checkQueryPolicy(pCtx.User, &req.CriblQuery)
+}
+
+// PublishStream is called when a client sends a message to a stream.  Our streams are read-only.
+func (d *Datasource) PublishStream(_ context.Context, _ *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream is called once for a channel when its first client subscribes.  The context is canceled
+// when the last client unsubscribes.
+func (d *Datasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	streamReq, err := parseStreamQueryRequest(req.Path, req.Data)
+	if err != nil {
+		return err
+	}
+	if err := d.checkStreamAccess(req.Path, req.PluginContext, streamReq); err != nil {
+		return err
+	}
+	ctx, cancel := d.withLifetime(ctx)
+	defer cancel()
+	streamReq.crumb = d.newBreadcrumb(ctx, req.PluginContext, streamReq.RefID, streamReq.JobTags)
+	startTime := time.Now()
+	if strings.HasPrefix(req.Path, STREAM_PATH_TAIL) {
+		err = d.runTailStream(ctx, streamReq, sender)
+	} else {
+		err = d.runQueryStream(ctx, streamReq, sender)
+	}
+
+	// A stream is audited once it ends, without the frames it sent along the way.  Its error, if any,
+	// may only be returned once the last subscriber has left.
+	var response backend.DataResponse
+	if err != nil && !errors.Is(err, context.Canceled) {
+		response = errorResponse(err)
+	}
+	d.auditQuery(req.PluginContext, backend.DataQuery{RefID: streamReq.RefID, TimeRange: streamReq.TimeRange(), JSON: req.Data}, response, startTime)
+	return err
+}
+
+// Run a query, pushing frames of new events as Cribl produces them, along with the job's status and
+// progress in the frame metadata.  Frames are append-only: each carries only events not yet sent.
+// Once the job has finished we hang around until the last subscriber leaves, otherwise Grafana would
+// restart the stream (and the job).  Saved searches' cached results are subject to the query's freshness
+// policy.  If the job fails, or runs past the query's timeout (like
+// Datasource.query), the last frame carries an error notice, and the error is returned once the last
+// subscriber leaves.
+func (d *Datasource) runQueryStream(ctx context.Context, req *streamQueryRequest, sender *backend.StreamSender) error {
+	queryCounter.WithLabelValues(req.Type).Inc()
+	queryParams, meta, err := d.buildQueryParams(&req.CriblQuery, req.TimeRange(), req.crumb)
+	if err != nil {
+		return err
+	}
+	timeFields := resolveTimeFields(d.Settings, &req.CriblQuery)
+	executedQuery := stripBreadcrumb(queryParams.Get("query"))
+	maxQueryDuration := queryTimeout(d.Settings, &req.CriblQuery)
+	startTime := time.Now()
+
+	eventCount := 0
+	lastStatus := ""
+	isFirstResponse := true
+	a, b := 100*time.Millisecond, 100*time.Millisecond // for Fibonacci backoff
+	for {
+		queryParams.Set("offset", strconv.Itoa(eventCount))
+		queryParams.Set("limit", strconv.Itoa(MAX_RESULTS-eventCount))
+		result, err := d.SearchAPI.RunQueryAndGetResults(&queryParams)
+		if err != nil {
+			backend.Logger.Debug("stream query failed", "err", err)
+			return err
+		}
+		job, _ := result.Header["job"].(map[string]interface{})
+		if job == nil || job["id"] == nil {
+			return fmt.Errorf("unexpected error: response header line has no job or job id")
+		}
+		jobId := job["id"].(string)
+		status, _ := job["status"].(string)
+		isFinished, _ := result.Header["isFinished"].(bool)
+
+		// The first response for a saved search's cached results is subject to the query's freshness
+		// policy, same as Datasource.query
+		var failure error
+		if isFirstResponse && meta.SavedSearchMode == SAVED_SEARCH_MODE_CACHED {
+			isFirstResponse = false
+			rerun, err := shouldRerunCachedResults(&req.CriblQuery, job, isFinished, time.Now())
+			switch {
+			case err != nil:
+				// Cribl already kicked off a new job in lieu of cached results, which we don't want
+				d.cancelQuery(jobId, err.Error())
+				failure = invalidQueryError(err)
+				result.Events = nil
+			case rerun:
+				backend.Logger.Debug("cached results are stale, re-running saved search", "jobId", jobId)
+				rerunQuery := req.CriblQuery
+				rerunQuery.SavedSearchMode = SAVED_SEARCH_MODE_SAVED_RANGE
+				if queryParams, meta, err = d.buildQueryParams(&rerunQuery, req.TimeRange(), req.crumb); err != nil {
+					return err
+				}
+				executedQuery = stripBreadcrumb(queryParams.Get("query"))
+				continue
+			}
+		}
+		isFirstResponse = false
+
+		// Lock to the job, same as Datasource.query
+		queryParams = url.Values{}
+		queryParams.Set("jobId", jobId)
+
+		frame := data.NewFrame("results")
+		frame.RefID = req.RefID
+		builder := newFrameBuilder(frame, timeFields)
+		for _, event := range result.Events {
+			builder.addEvent(event)
+			resultsCounter.WithLabelValues(req.Type).Inc()
+		}
+		builder.finish()
+		eventCount += builder.eventCount
+
+		done := failure != nil || isFinished && (status != "completed" || eventCount >= MAX_RESULTS || eventCount >= totalEventCountOf(result.Header))
+		switch {
+		case failure != nil:
+			// already failed, by the freshness policy
+		case done && status != "completed":
+			failure = invalidQueryError(fmt.Errorf("Job %s ended with status %s", jobId, status))
+		case !isFinished && maxQueryDuration > 0 && time.Since(startTime) >= maxQueryDuration:
+			// Jobs we merely attached to belong to someone else, leave them running
+			if req.Type != "job" {
+				backend.Logger.Debug("stream query timed out, canceling", "jobId", jobId)
+				d.cancelQuery(jobId, "query timed out")
+			}
+			failure = timeoutError(fmt.Errorf("Job %s still not finished after %v (status=%v), only the %d events it had produced are shown. Consider using a scheduled search to speed this up. https://docs.cribl.io/search/scheduled-searches/", jobId, maxQueryDuration, status, eventCount))
+			done = true
+		}
+		meta.JobId = jobId
+		meta.JobStatus = status
+		meta.EventCount = eventCount
+		meta.Finished = done
+		frame.Meta = &data.FrameMeta{ExecutedQueryString: executedQuery, Custom: meta}
+		if failure != nil {
+			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityError, Text: failure.Error()})
+		}
+		if builder.eventCount > 0 || status != lastStatus || done {
+			if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+				return err
+			}
+		}
+		lastStatus = status
+
+		if done {
+			backend.Logger.Debug("stream query finished", "jobId", jobId, "status", status, "eventCount", eventCount, "err", failure)
+			<-ctx.Done()
+			return failure
+		}
+
+		// If the job has finished there are more pages to fetch, no need to wait
+		backoffDuration := time.Duration(0)
+		if !isFinished {
+			a, b = b, a+b // Fibonacci backoff
+			backoffDuration = min(a, MAX_BACKOFF_DURATION)
+			if maxQueryDuration > 0 {
+				backoffDuration = max(min(backoffDuration, time.Until(startTime.Add(maxQueryDuration))), 0)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if req.Type != "job" {
+				d.cancelQuery(jobId, "stream closed")
+			}
+			return nil
+		case <-time.After(backoffDuration):
+		}
+	}
+}
+
+// Read totalEventCount from a response header, which is only trustworthy once the job is finished
+func totalEventCountOf(header map[string]interface{}) int {
+	if total, ok := header["totalEventCount"].(float64); ok {
+		return int(total)
+	}
+	return 0
+}
+
+// Live tail an ad-hoc query, like "tail -f".  Every interval, the query runs over a sliding window
+// from the latest _time seen so far up to now, and only new events are pushed, as append-only frames.
+// The window's start is inclusive, since more events may have arrived with that same _time, so events
+// at the edge are de-duplicated.  Runs until the last subscriber leaves, canceling any in-flight job.
+func (d *Datasource) runTailStream(ctx context.Context, req *streamQueryRequest, sender *backend.StreamSender) error {
+	query, err := applyAdhocFilters(req.Query, req.AdhocFilters)
+	if err != nil {
+		return err
+	}
+	query, _, _ = restrictDatasets(d.Settings, query)
+	preparedQuery := prepareQuery(query, req.crumb)
+	timeFields := resolveTimeFields(d.Settings, &req.CriblQuery)
+	interval := req.TailInterval()
+
+	tail := newTailWindow(time.Now().Add(-DEFAULT_TAIL_LOOKBACK))
+	if req.From > 0 {
+		tail = newTailWindow(time.UnixMilli(req.From))
+	}
+	backend.Logger.Debug("starting live tail", "since", tail.since, "interval", interval)
+	for {
+		queryCounter.WithLabelValues("tail").Inc()
+		queryParams := url.Values{}
+		queryParams.Set("query", preparedQuery)
+		queryParams.Set("earliest", formatCriblTime(tail.since))
+		queryParams.Set("latest", formatCriblTime(time.Now()))
+		queryParams.Set("limit", strconv.Itoa(MAX_RESULTS))
+		result, err := d.SearchAPI.runQueryToCompletion(ctx, &queryParams)
+		if ctx.Err() != nil {
+			backend.Logger.Debug("live tail closed")
+			return nil
+		}
+		if err != nil {
+			backend.Logger.Warn("live tail query failed, will retry", "err", err)
+		} else if events := tail.newEvents(result.Events); len(events) > 0 {
+			frame := data.NewFrame("results")
+			frame.RefID = req.RefID
+			builder := newFrameBuilder(frame, timeFields)
+			for _, event := range events {
+				builder.addEvent(event)
+				resultsCounter.WithLabelValues("tail").Inc()
+			}
+			builder.finish()
+			if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			backend.Logger.Debug("live tail closed")
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Tracks the sliding window of a live tail: the latest _time seen, and the events seen at that
+// exact time, so they aren't sent twice when the next window starts there.
+type tailWindow struct {
+	since      time.Time
+	seenAtEdge map[string]bool // fingerprints of events whose _time == since
+}
+
+func newTailWindow(since time.Time) *tailWindow {
+	return &tailWindow{since: since, seenAtEdge: map[string]bool{}}
+}
+
+// Given the events of the latest window, return those not sent before (ordered by _time), and
+// slide the window forward.  Events without a usable _time can't be placed in a window, so they're
+// dropped.
+func (w *tailWindow) newEvents(events []map[string]interface{}) []map[string]interface{} {
+	type timedEvent struct {
+		t           time.Time
+		fingerprint string
+		event       map[string]interface{}
+	}
+	var fresh []timedEvent
+	for _, event := range events {
+		ok, t := criblTimeToGrafanaTime(event[CRIBL_TIME_FIELD])
+		if !ok || t.Before(w.since) {
+			continue
+		}
+		fingerprint, _ := json.Marshal(event) // map keys are sorted, so this is stable
+		if t.Equal(w.since) && w.seenAtEdge[string(fingerprint)] {
+			continue
+		}
+		fresh = append(fresh, timedEvent{t, string(fingerprint), event})
+	}
+	sort.SliceStable(fresh, func(i, j int) bool { return fresh[i].t.Before(fresh[j].t) })
+
+	out := make([]map[string]interface{}, 0, len(fresh))
+	for _, e := range fresh {
+		if e.t.After(w.since) {
+			w.since = e.t
+			w.seenAtEdge = map[string]bool{}
+		}
+		w.seenAtEdge[e.fingerprint] = true
+		out = append(out, e.event)
+	}
+	return out
+}
@@ -0,0 +1,315 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+// Collects the packets sent to a stream
+type testPacketSender struct {
+	mu      sync.Mutex
+	packets []*backend.StreamPacket
+}
+
+func (s *testPacketSender) Send(packet *backend.StreamPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets = append(s.packets, packet)
+	return nil
+}
+
+func (s *testPacketSender) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.packets)
+}
+
+func TestParseStreamQueryRequest(t *testing.T) {
+	req, err := parseStreamQueryRequest("query/Q1-A", []byte(`{"type":"adhoc","query":"dataset=\"foo\"","refId":"A","from":1728744793000,"to":1728748393000}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "adhoc", req.Type)
+	assert.Equal(t, "A", req.RefID)
+	assert.Equal(t, time.UnixMilli(1728744793000), req.TimeRange().From)
+
+	_, err = parseStreamQueryRequest("query/Q1-A", []byte(`{"type":"adhoc","query":" "}`))
+	assert.NotNil(t, err, "can't run an empty query")
+	_, err = parseStreamQueryRequest("query/Q1-A", []byte(`{"type":"jobs"}`))
+	assert.NotNil(t, err, "job history isn't streamable")
+	_, err = parseStreamQueryRequest("query/Q1-A", []byte(`not json`))
+	assert.NotNil(t, err)
+}
+
+// Get the channel path issued to a user for a stream
+func issueStreamPath(t *testing.T, ds *Datasource, pCtx backend.PluginContext, kind string, id string, data string) string {
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"kind":%q,"id":%q,"data":%s}`, kind, id, data)
+	ds.handleStreamPath(w, httptest.NewRequest(http.MethodPost, "/streamPath", strings.NewReader(body)).WithContext(backend.WithPluginContext(context.Background(), pCtx)))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response map[string]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response["path"]
+}
+
+func TestSubscribeStream(t *testing.T) {
+	ds := &Datasource{Settings: &models.PluginSettings{}}
+	alice := backend.PluginContext{OrgID: 1, User: &backend.User{Login: "alice", Role: "Editor"}}
+	bob := backend.PluginContext{OrgID: 1, User: &backend.User{Login: "bob", Role: "Viewer"}}
+	data := []byte(`{"type":"job","jobId":"123"}`)
+	path := issueStreamPath(t, ds, alice, "query", "Q1-A", `{ "jobId": "123", "type": "job" }`)
+	assert.True(t, strings.HasPrefix(path, "query/Q1-A/"), path)
+
+	res, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: alice, Path: path, Data: data})
+	assert.Nil(t, err)
+	assert.Equal(t, backend.SubscribeStreamStatusOK, res.Status, "the same query, however it's encoded")
+
+	res, _ = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: alice, Path: "bogus/Q1-A", Data: data})
+	assert.Equal(t, backend.SubscribeStreamStatusNotFound, res.Status)
+
+	// A channel can't be joined by another user, or with another query
+	res, _ = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: bob, Path: path, Data: data})
+	assert.Equal(t, backend.SubscribeStreamStatusPermissionDenied, res.Status)
+	res, _ = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: alice, Path: path, Data: []byte(`{"type":"job","jobId":"456"}`)})
+	assert.Equal(t, backend.SubscribeStreamStatusPermissionDenied, res.Status)
+	res, _ = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: alice, Path: "query/Q1-A", Data: data})
+	assert.Equal(t, backend.SubscribeStreamStatusPermissionDenied, res.Status)
+
+	// Every subscriber must be allowed to run the query
+	ds.Settings.AdhocMinRole = "Editor"
+	path = issueStreamPath(t, ds, bob, "query", "Q1-A", string(data))
+	res, _ = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: bob, Path: path, Data: data})
+	assert.Equal(t, backend.SubscribeStreamStatusPermissionDenied, res.Status)
+
+	pub, _ := ds.PublishStream(context.Background(), &backend.PublishStreamRequest{Path: path})
+	assert.Equal(t, backend.PublishStreamStatusPermissionDenied, pub.Status)
+}
+
+func TestRunQueryStream(t *testing.T) {
+	// The job produces one event per poll, finishing after the second
+	var mu sync.Mutex
+	polls := 0
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		polls++
+		switch polls {
+		case 1:
+			w.Write([]byte(`{"isFinished":false,"job":{"id":"j1","status":"running"}}` + "\n" + `{"_time":1728744793,"n":1}`))
+		default:
+			assert.Equal(t, "j1", r.URL.Query().Get("jobId"))
+			assert.Equal(t, "1", r.URL.Query().Get("offset"), "only new events are fetched")
+			w.Write([]byte(`{"isFinished":true,"totalEventCount":2,"job":{"id":"j1","status":"completed"}}` + "\n" + `{"_time":1728744794,"n":2}`))
+		}
+	})
+
+	sender := &testPacketSender{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		req, _ := parseStreamQueryRequest("query/Q1-A", []byte(`{"type":"job","jobId":"j1","refId":"A"}`))
+		done <- ds.runQueryStream(ctx, req, backend.NewStreamSender(sender))
+	}()
+
+	assert.Eventually(t, func() bool { return sender.count() == 2 }, 5*time.Second, 10*time.Millisecond)
+	cancel() // last subscriber leaves
+	assert.Nil(t, <-done)
+	assert.Contains(t, string(sender.packets[1].Data), `"finished":true`)
+}
+
+func TestRunQueryStreamFailure(t *testing.T) {
+	for _, test := range []struct {
+		Name           string
+		Response       string
+		TimeoutSec     float64
+		ExpectedStatus backend.Status
+		ExpectedNotice string
+	}{
+		{"failed", `{"isFinished":true,"totalEventCount":0,"job":{"id":"j1","status":"failed"}}`, 0, backend.StatusBadRequest, "Job j1 ended with status failed"},
+		{"timed out", `{"isFinished":false,"job":{"id":"j1","status":"running"}}` + "\n" + `{"_time":1728744793,"n":1}`, 0.2, backend.StatusTimeout, "Job j1 still not finished after 200ms"},
+	} {
+		var mu sync.Mutex
+		var canceled bool
+		ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.HasSuffix(r.URL.Path, "/cancel") {
+				canceled = true
+				return
+			}
+			if r.URL.Query().Get("offset") != "0" {
+				w.Write([]byte(`{"isFinished":false,"job":{"id":"j1","status":"running"}}`))
+				return
+			}
+			w.Write([]byte(test.Response))
+		})
+		ds.Settings.QueryTimeoutSec = &test.TimeoutSec
+
+		sender := &testPacketSender{}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			req, _ := parseStreamQueryRequest("query/Q1-A", []byte(`{"type":"adhoc","query":"dataset=\"foo\"","refId":"A"}`))
+			done <- ds.runQueryStream(ctx, req, backend.NewStreamSender(sender))
+		}()
+
+		assert.Eventually(t, func() bool {
+			sender.mu.Lock()
+			defer sender.mu.Unlock()
+			return len(sender.packets) > 0 && strings.Contains(string(sender.packets[len(sender.packets)-1].Data), `"finished":true`)
+		}, 5*time.Second, 10*time.Millisecond, test.Name)
+		cancel() // last subscriber leaves
+		err := <-done
+		assert.NotNil(t, err, test.Name)
+		assert.Equal(t, test.ExpectedStatus, errorResponse(err).Status, test.Name)
+		last := string(sender.packets[len(sender.packets)-1].Data)
+		assert.Contains(t, last, `"severity":"error"`, test.Name)
+		assert.Contains(t, last, test.ExpectedNotice, test.Name)
+		mu.Lock()
+		assert.Equal(t, test.TimeoutSec > 0, canceled, "%v: a timed out job is canceled", test.Name)
+		mu.Unlock()
+	}
+}
+
+func TestRunQueryStreamFreshness(t *testing.T) {
+	stale := time.Now().Add(-2 * time.Hour).UnixMilli()
+	for _, test := range []struct {
+		Name           string
+		Query          string
+		FirstResponse  string
+		ExpectedNotice string
+		ExpectedRerun  bool
+	}{
+		{"cache only, no cached results", `{"type":"saved","savedSearchId":"s1","savedSearchFreshness":"cacheOnly","refId":"A"}`, `{"isFinished":false,"job":{"id":"new","status":"running"}}`, "Saved search s1 has no cached results", false},
+		{"stale cached results", `{"type":"saved","savedSearchId":"s1","savedSearchFreshness":"maxAge","maxAgeMinutes":60,"refId":"A"}`, fmt.Sprintf(`{"isFinished":true,"totalEventCount":1,"job":{"id":"cached","status":"completed","timeCompleted":%d}}`+"\n"+`{"n":1}`, stale), "", true},
+	} {
+		var mu sync.Mutex
+		var canceled, reran bool
+		ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/cancel"):
+				canceled = true
+			case strings.HasSuffix(r.URL.Path, "/saved/s1"):
+				w.Write([]byte(`{"items":[{"id":"s1","query":"dataset=\"foo\"","earliest":"-1h","latest":"now"}]}`))
+			case r.URL.Query().Get("queryId") == "s1":
+				w.Write([]byte(test.FirstResponse))
+			default:
+				reran = reran || strings.HasPrefix(r.URL.Query().Get("query"), `dataset="foo"`)
+				w.Write([]byte(`{"isFinished":true,"totalEventCount":1,"job":{"id":"rerun","status":"completed"}}` + "\n" + `{"n":2}`))
+			}
+		})
+
+		sender := &testPacketSender{}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			req, _ := parseStreamQueryRequest("query/Q1-A", []byte(test.Query))
+			done <- ds.runQueryStream(ctx, req, backend.NewStreamSender(sender))
+		}()
+		assert.Eventually(t, func() bool {
+			sender.mu.Lock()
+			defer sender.mu.Unlock()
+			return len(sender.packets) > 0 && strings.Contains(string(sender.packets[len(sender.packets)-1].Data), `"finished":true`)
+		}, 5*time.Second, 10*time.Millisecond, test.Name)
+		cancel()
+		err := <-done
+
+		last := string(sender.packets[len(sender.packets)-1].Data)
+		mu.Lock()
+		if len(test.ExpectedNotice) > 0 {
+			assert.NotNil(t, err, test.Name)
+			assert.Contains(t, last, test.ExpectedNotice, test.Name)
+			assert.True(t, canceled, "%v: the job Cribl kicked off is canceled", test.Name)
+		} else {
+			assert.Nil(t, err, test.Name)
+			assert.Contains(t, last, `"jobId":"rerun"`, test.Name)
+			assert.NotContains(t, last, `"jobId":"cached"`, test.Name)
+		}
+		assert.Equal(t, test.ExpectedRerun, reran, test.Name)
+		mu.Unlock()
+	}
+}
+
+func TestTailWindow(t *testing.T) {
+	since := time.Unix(1728744793, 0)
+	window := newTailWindow(since)
+	ids := func(events []map[string]interface{}) []interface{} {
+		var out []interface{}
+		for _, event := range events {
+			out = append(out, event["id"])
+		}
+		return out
+	}
+
+	// Out of order, one too old, one without a time
+	events := window.newEvents([]map[string]interface{}{
+		{"_time": float64(1728744795), "id": "c"},
+		{"_time": float64(1728744794), "id": "b"},
+		{"_time": float64(1728744792), "id": "old"},
+		{"id": "no time"},
+		{"_time": float64(1728744795), "id": "d"},
+	})
+	assert.Equal(t, []interface{}{"b", "c", "d"}, ids(events))
+	assert.Equal(t, time.Unix(1728744795, 0).UTC(), window.since)
+
+	// The next window starts at the last _time seen, so c & d come back and must be skipped
+	events = window.newEvents([]map[string]interface{}{
+		{"_time": float64(1728744795), "id": "c"},
+		{"_time": float64(1728744795), "id": "d"},
+		{"_time": float64(1728744795), "id": "e"},
+		{"_time": float64(1728744796), "id": "f"},
+	})
+	assert.Equal(t, []interface{}{"e", "f"}, ids(events))
+	assert.Equal(t, time.Unix(1728744796, 0).UTC(), window.since)
+
+	assert.Empty(t, window.newEvents([]map[string]interface{}{{"_time": float64(1728744796), "id": "f"}}))
+}
+
+func TestRunTailStreamRestrictsDatasets(t *testing.T) {
+	queries := make(chan string, 10)
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case queries <- r.URL.Query().Get("query"):
+		default:
+		}
+		w.Write([]byte(`{"isFinished":true,"totalEventCount":0,"job":{"id":"j1","status":"completed"}}`))
+	})
+	ds.Settings.AllowedDatasets = []string{"foo"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		req, _ := parseStreamQueryRequest("tail/Q1-A", []byte(`{"type":"adhoc","query":"dataset=\"foo\" or true","refId":"A"}`))
+		done <- ds.runTailStream(ctx, req, backend.NewStreamSender(&testPacketSender{}))
+	}()
+	query := <-queries
+	cancel()
+	assert.Nil(t, <-done)
+	assert.Equal(t, "dataset=\"foo\" or true | where dataset in (\"foo\")\n// Grafana plugin", query)
+}
+
+func TestTailInterval(t *testing.T) {
+	assert.Equal(t, DEFAULT_TAIL_INTERVAL, (&streamQueryRequest{}).TailInterval())
+	assert.Equal(t, 10*time.Second, (&streamQueryRequest{TailIntervalSec: 10}).TailInterval())
+	assert.Equal(t, MIN_TAIL_INTERVAL, (&streamQueryRequest{TailIntervalSec: 0.01}).TailInterval())
+}
+
+func TestParseTailStreamRequest(t *testing.T) {
+	_, err := parseStreamQueryRequest("tail/Q1-A", []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`))
+	assert.Nil(t, err)
+	_, err = parseStreamQueryRequest("tail/Q1-A", []byte(`{"type":"job","jobId":"123"}`))
+	assert.NotNil(t, err, "only adhoc queries can be tailed")
+	_, err = parseStreamQueryRequest("bogus/Q1-A", []byte(`{"type":"adhoc","query":"dataset=\"foo\""}`))
+	assert.NotNil(t, err)
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/build/buildinfo"
 )
 
@@ -35,37 +36,181 @@ func canRunQuery(criblQuery *models.CriblQuery) error {
 		if len(criblQuery.SavedSearchId) == 0 {
 			return errors.New("saved search ID is missing")
 		}
+	case "job":
+		if len(strings.TrimSpace(criblQuery.JobId)) == 0 {
+			return errors.New("job ID is missing")
+		}
+	case "jobs":
+		// Job history needs nothing more than the time range
 	default:
 		return fmt.Errorf("unsupported query type: %v", criblQuery.Type)
 	}
 	return nil
 }
 
-// Prepare a query for execution by collapsing it to a single line and adding a breadcrumb
-// to help identify queries from the Grafana plugin in the search job history.
-func prepareQuery(query string) string {
-	collapsed := regexp.MustCompile("[\r\n\t]+").ReplaceAllString(query, " ")
-	return collapsed + "\n// Grafana plugin"
+// Prepare a query for execution by collapsing it to a single line (stripping comments) and adding a
+// breadcrumb to help identify queries from the Grafana plugin in the search job history, i.e.
+// "// Grafana plugin dashboard=abc panel=2 tags=nightly,report".  The breadcrumb may be nil.
+func prepareQuery(query string, crumb *breadcrumb) string {
+	collapsed, _ := normalizeKql(query)
+	return collapsed + "\n" + crumb.String()
+}
+
+var jobTagRegex = regexp.MustCompile(`[^A-Za-z0-9_.:/@-]+`)
+
+// Clean up job tags so they can't break out of the breadcrumb comment: only letters, digits and
+// "_.:/@-" are kept, blank tags are dropped, and there are at most MAX_JOB_TAGS.
+func sanitizeJobTags(tags []string) []string {
+	var sanitized []string
+	for _, tag := range tags {
+		if tag = jobTagRegex.ReplaceAllString(strings.TrimSpace(tag), "_"); len(strings.Trim(tag, "_")) > 0 {
+			sanitized = append(sanitized, tag)
+		}
+		if len(sanitized) == MAX_JOB_TAGS {
+			break
+		}
+	}
+	return sanitized
+}
+
+// The timeout for a query: its own timeout if it has one, otherwise the data source's, capped by the
+// admin's max (if any).  Zero means no timeout.
+func queryTimeout(settings *models.PluginSettings, criblQuery *models.CriblQuery) time.Duration {
+	timeout := time.Duration(0)
+	if settings.QueryTimeoutSec != nil && *settings.QueryTimeoutSec > 0 {
+		timeout = time.Duration(*settings.QueryTimeoutSec * 1e9)
+	}
+	if criblQuery.TimeoutSec != nil && *criblQuery.TimeoutSec > 0 {
+		timeout = time.Duration(*criblQuery.TimeoutSec * 1e9)
+	}
+	if settings.MaxQueryTimeoutSec != nil && *settings.MaxQueryTimeoutSec > 0 {
+		maxTimeout := time.Duration(*settings.MaxQueryTimeoutSec * 1e9)
+		if timeout == 0 || timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+	}
+	return timeout
+}
+
+// Format a time as epoch seconds for Cribl's earliest/latest, retaining millisecond precision
+func formatCriblTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000.0, 'f', -1, 64)
 }
 
-// Convert the value of the "_time" field (expected to be in seconds) to a time.Time in UTC
+// Determine the earliest & latest to send to Cribl for a query.  Normally these are absolute times
+// with millisecond precision.  When the query opts into relative time ranges and the dashboard's
+// range is relative (i.e. "now-1h" to "now"), the equivalent Cribl expressions are used instead,
+// which lets Cribl reuse cached results across refreshes.
+func criblTimeRange(criblQuery *models.CriblQuery, timeRange backend.TimeRange) (string, string) {
+	earliest, latest := formatCriblTime(timeRange.From), formatCriblTime(timeRange.To)
+	if criblQuery.RelativeTimeRange && criblQuery.TimeRangeRaw != nil {
+		relEarliest, okEarliest := grafanaRelativeTimeToCribl(criblQuery.TimeRangeRaw.From, false)
+		relLatest, okLatest := grafanaRelativeTimeToCribl(criblQuery.TimeRangeRaw.To, true)
+		// All or nothing, we don't want to mix relative and absolute
+		if okEarliest && okLatest {
+			return relEarliest, relLatest
+		}
+	}
+	return earliest, latest
+}
+
+var grafanaRelativeTimeRegex = regexp.MustCompile(`^now(?:-(\d+)([smhdwMy]))?(?:/([smhdwMy]))?$`)
+
+// Convert a Grafana relative time expression (i.e. "now-1h", "now-1d/d") to the Cribl equivalent
+// (i.e. "-1h", "-1d@d").  Returns false if the expression isn't relative or has no Cribl equivalent.
+// Rounding is only supported on earliest, since Grafana rounds latest up to the end of the unit
+// whereas Cribl always snaps down.
+func grafanaRelativeTimeToCribl(expr string, isLatest bool) (string, bool) {
+	match := grafanaRelativeTimeRegex.FindStringSubmatch(strings.TrimSpace(expr))
+	if match == nil {
+		return "", false
+	}
+	amount, unit, snapUnit := match[1], match[2], match[3]
+	if len(amount) == 0 && len(snapUnit) == 0 {
+		return "now", true
+	}
+	if len(snapUnit) > 0 && isLatest {
+		return "", false
+	}
+	criblUnit := func(u string) string {
+		if u == "M" {
+			return "mon" // Grafana's month unit, not to be confused with minutes
+		}
+		return u
+	}
+	var result string
+	if len(amount) > 0 {
+		result = fmt.Sprintf("-%s%s", amount, criblUnit(unit))
+	}
+	if len(snapUnit) > 0 {
+		result = fmt.Sprintf("%s@%s", result, criblUnit(snapUnit))
+	}
+	return result, true
+}
+
+// Convert the value of a time field (i.e. "_time") to a time.Time in UTC.  Accepts epoch times as
+// numbers or numeric strings, detecting the unit (seconds, millis, micros or nanos) from the magnitude,
+// as well as RFC3339 strings.
 func criblTimeToGrafanaTime(timeValue interface{}) (bool, time.Time) {
-	var seconds float64
+	var epoch float64
 	switch v := timeValue.(type) {
 	case float64:
-		seconds = v
+		epoch = v
 	case string:
 		s, err := strconv.ParseFloat(v, 64)
 		if err != nil {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return true, t.UTC()
+			}
 			return false, time.Time{}
 		}
-		seconds = s
+		epoch = s
 	default:
 		return false, time.Time{}
 	}
-	wholeSec := int64(seconds)
-	nanoSec := int64(math.Round((seconds-float64(wholeSec))*1000000.0)) * 1000 // microsec precision
-	return true, time.Unix(wholeSec, nanoSec).UTC()
+
+	// Anything below 1e11 seconds is before the year 5138, so we can safely assume seconds.  Each
+	// subsequent unit is 1000x bigger.
+	switch magnitude := math.Abs(epoch); {
+	case magnitude < 1e11:
+		wholeSec := int64(epoch)
+		nanoSec := int64(math.Round((epoch-float64(wholeSec))*1000000.0)) * 1000 // microsec precision
+		return true, time.Unix(wholeSec, nanoSec).UTC()
+	case magnitude < 1e14:
+		return true, time.UnixMicro(int64(math.Round(epoch * 1000))).UTC()
+	case magnitude < 1e17:
+		return true, time.UnixMicro(int64(math.Round(epoch))).UTC()
+	default:
+		return true, time.Unix(0, int64(epoch)).UTC()
+	}
+}
+
+// Determine which fields should be treated as time fields for a query.  The query's own list wins,
+// then the data source's default, falling back to Cribl's "_time".
+func resolveTimeFields(settings *models.PluginSettings, criblQuery *models.CriblQuery) map[string]bool {
+	names := criblQuery.TimeFields
+	if len(names) == 0 && settings != nil {
+		names = settings.TimeFields
+	}
+	timeFields := map[string]bool{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			timeFields[name] = true
+		}
+	}
+	if len(timeFields) == 0 {
+		timeFields[CRIBL_TIME_FIELD] = true
+	}
+	return timeFields
+}
+
+// Read a time (epoch millis) from a job object, i.e. "timeCompleted"
+func jobTime(job map[string]interface{}, key string) (time.Time, bool) {
+	millis, ok := job[key].(float64)
+	if !ok || millis <= 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(millis)).UTC(), true
 }
 
 // Grafana's data.NewField() is super finicky.  You're force to supply an array of values,
@@ -126,7 +271,13 @@ func parseJavaScriptError(body []byte) error {
 	for key, value := range fields {
 		extras = append(extras, fmt.Sprintf("%s: %v", key, value))
 	}
-	return fmt.Errorf("%v: %v (%+v)", name, message, strings.Join(extras, ", "))
+	err := fmt.Errorf("%v: %v (%+v)", name, message, strings.Join(extras, ", "))
+
+	// Syntax errors may say where in the query they were found
+	if offset, length, ok := errorPosition(fields); ok {
+		return &positionedError{err: err, offset: offset, length: length}
+	}
+	return err
 }
 
 // Determine if a supplied URL is well-formed, i.e. including scheme and host
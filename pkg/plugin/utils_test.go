@@ -3,8 +3,10 @@ package plugin
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/criblcloud/search-datasource/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,11 +31,45 @@ func TestCanRunQuery(t *testing.T) {
 	if canRunQuery(&models.CriblQuery{Type: "adhoc", SavedSearchId: ""}) == nil {
 		t.Fatal("should not be able to run saved with empty savedSearchId")
 	}
+
+	if canRunQuery(&models.CriblQuery{Type: "job"}) == nil {
+		t.Fatal("should not be able to run job with no jobId")
+	}
+	if canRunQuery(&models.CriblQuery{Type: "job", JobId: " "}) == nil {
+		t.Fatal("should not be able to run job with blank jobId")
+	}
+	if canRunQuery(&models.CriblQuery{Type: "job", JobId: "1728744793123.abcdef"}) != nil {
+		t.Fatal("should be able to run job with a jobId")
+	}
 }
 
 func TestPrepareQuery(t *testing.T) {
-	assert.Equal(t, "hello there dude\n// Grafana plugin", prepareQuery("hello\nthere\ndude"))
-	assert.Equal(t, "hello there aw yeah\n// Grafana plugin", prepareQuery("hello\nthere\taw\r\nyeah"))
+	assert.Equal(t, "hello there dude\n// Grafana plugin", prepareQuery("hello\nthere\ndude", nil))
+	assert.Equal(t, "hello there aw yeah\n// Grafana plugin", prepareQuery("hello\nthere\taw\r\nyeah", nil))
+	assert.Equal(t, "hello\n// Grafana plugin tags=nightly,team:ops", prepareQuery("hello", &breadcrumb{Tags: []string{"nightly", " ", "team:ops"}}))
+	assert.Equal(t, "hello\n// Grafana plugin tags=a_b_c", prepareQuery("hello", &breadcrumb{Tags: []string{"a\nb c"}}), "tags can't break out of the comment")
+	assert.Equal(t, "hello  there\n// Grafana plugin", prepareQuery("hello // world\nthere", nil), "comments don't swallow the rest of the query")
+}
+
+func TestQueryTimeout(t *testing.T) {
+	seconds := func(s float64) *float64 { return &s }
+	for _, test := range []struct {
+		Default  *float64
+		Max      *float64
+		Query    *float64
+		Expected time.Duration
+	}{
+		{nil, nil, nil, 0},
+		{seconds(30), nil, nil, 30 * time.Second},
+		{seconds(30), nil, seconds(120), 120 * time.Second},
+		{seconds(30), seconds(60), seconds(120), 60 * time.Second},
+		{seconds(30), seconds(60), seconds(10), 10 * time.Second},
+		{nil, seconds(60), nil, 60 * time.Second},
+		{seconds(30), nil, seconds(0), 30 * time.Second},
+	} {
+		settings := &models.PluginSettings{QueryTimeoutSec: test.Default, MaxQueryTimeoutSec: test.Max}
+		assert.Equal(t, test.Expected, queryTimeout(settings, &models.CriblQuery{TimeoutSec: test.Query}))
+	}
 }
 
 func TestCriblTimeToGrafanaTime(t *testing.T) {
@@ -69,6 +105,34 @@ func TestCriblTimeToGrafanaTime(t *testing.T) {
 			In:       float64(1728744793.123456),
 			Expected: 1728744793123456,
 		},
+		{
+			In:       "1728744793.5",
+			Expected: 1728744793500000,
+		},
+		{
+			In:       float64(1728744793123),
+			Expected: 1728744793123000,
+		},
+		{
+			In:       "1728744793123",
+			Expected: 1728744793123000,
+		},
+		{
+			In:       float64(1728744793123456),
+			Expected: 1728744793123456,
+		},
+		{
+			In:       "1728744793123456789",
+			Expected: 1728744793123456,
+		},
+		{
+			In:       "2024-10-12T14:53:13.123456Z",
+			Expected: 1728744793123456,
+		},
+		{
+			In:       "2024-10-12T16:53:13+02:00",
+			Expected: 1728744793000000,
+		},
 	} {
 		ok, out := criblTimeToGrafanaTime(test.In)
 		if test.Expected == 0 {
@@ -156,3 +220,63 @@ func TestIsLocalDevelopmentURL(t *testing.T) {
 	assert.True(t, isLocalDevelopmentURL("https://host.docker.internal"), "docker internal https")
 	assert.True(t, isLocalDevelopmentURL("https://host.docker.internal:9000"), "docker internal with port")
 }
+
+func TestResolveTimeFields(t *testing.T) {
+	assert.Equal(t, map[string]bool{"_time": true}, resolveTimeFields(&models.PluginSettings{}, &models.CriblQuery{}))
+	assert.Equal(t, map[string]bool{"timestamp": true, "bucket": true},
+		resolveTimeFields(&models.PluginSettings{TimeFields: []string{"timestamp", " bucket "}}, &models.CriblQuery{}))
+	assert.Equal(t, map[string]bool{"ts": true},
+		resolveTimeFields(&models.PluginSettings{TimeFields: []string{"timestamp"}}, &models.CriblQuery{TimeFields: []string{"ts"}}))
+	assert.Equal(t, map[string]bool{"_time": true},
+		resolveTimeFields(&models.PluginSettings{TimeFields: []string{" "}}, &models.CriblQuery{}))
+}
+
+func TestFormatCriblTime(t *testing.T) {
+	assert.Equal(t, "1728744793", formatCriblTime(time.UnixMilli(1728744793000)))
+	assert.Equal(t, "1728744793.123", formatCriblTime(time.UnixMilli(1728744793123)))
+	assert.Equal(t, "1728744793.005", formatCriblTime(time.UnixMicro(1728744793005999)), "truncated to millis")
+}
+
+func TestGrafanaRelativeTimeToCribl(t *testing.T) {
+	for _, test := range []struct {
+		In       string
+		IsLatest bool
+		Expected string
+		Ok       bool
+	}{
+		{In: "now", Expected: "now", Ok: true},
+		{In: "now", IsLatest: true, Expected: "now", Ok: true},
+		{In: "now-1h", Expected: "-1h", Ok: true},
+		{In: "now-15m", Expected: "-15m", Ok: true},
+		{In: "now-3M", Expected: "-3mon", Ok: true},
+		{In: "now-1d/d", Expected: "-1d@d", Ok: true},
+		{In: "now/w", Expected: "@w", Ok: true},
+		{In: "now/d", IsLatest: true, Ok: false},
+		{In: "now-1d/d", IsLatest: true, Ok: false},
+		{In: "2024-10-12T00:00:00Z", Ok: false},
+		{In: "1728744793000", Ok: false},
+		{In: "", Ok: false},
+	} {
+		out, ok := grafanaRelativeTimeToCribl(test.In, test.IsLatest)
+		assert.Equal(t, test.Ok, ok, test.In)
+		assert.Equal(t, test.Expected, out, test.In)
+	}
+}
+
+func TestCriblTimeRange(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.UnixMilli(1728744793123), To: time.UnixMilli(1728748393456)}
+
+	earliest, latest := criblTimeRange(&models.CriblQuery{}, timeRange)
+	assert.Equal(t, "1728744793.123", earliest)
+	assert.Equal(t, "1728748393.456", latest)
+
+	relative := &models.CriblQuery{RelativeTimeRange: true, TimeRangeRaw: &models.RawTimeRange{From: "now-1h", To: "now"}}
+	earliest, latest = criblTimeRange(relative, timeRange)
+	assert.Equal(t, "-1h", earliest)
+	assert.Equal(t, "now", latest)
+
+	absolute := &models.CriblQuery{RelativeTimeRange: true, TimeRangeRaw: &models.RawTimeRange{From: "now-1h", To: "now/d"}}
+	earliest, latest = criblTimeRange(absolute, timeRange)
+	assert.Equal(t, "1728744793.123", earliest, "falls back to absolute when latest can't be converted")
+	assert.Equal(t, "1728748393.456", latest)
+}
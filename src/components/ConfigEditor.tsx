@@ -1,7 +1,20 @@
 import React, { ChangeEvent, useState } from 'react';
-import { InlineField, Input, SecretInput } from '@grafana/ui';
-import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
-import { CriblDataSourceOptions, CriblSecureJsonData } from 'types';
+import { InlineField, InlineSwitch, Input, SecretInput, Select } from '@grafana/ui';
+import { DataSourcePluginOptionsEditorProps, SelectableValue } from '@grafana/data';
+import { AdhocRole, AuditSink, CriblDataSourceOptions, CriblSecureJsonData } from 'types';
+
+const ADHOC_ROLE_OPTIONS: Array<SelectableValue<AdhocRole | ''>> = [
+  { label: 'Anyone', value: '', description: 'Anyone who can query the data source can run ad-hoc queries' },
+  { label: 'Viewer', value: 'Viewer' },
+  { label: 'Editor', value: 'Editor' },
+  { label: 'Admin', value: 'Admin' },
+];
+
+const AUDIT_SINK_OPTIONS: Array<SelectableValue<AuditSink>> = [
+  { label: 'None', value: '', description: "Don't keep an audit log" },
+  { label: 'Plugin log', value: 'log', description: "Write a record of each query to the plugin's log" },
+  { label: 'File', value: 'file', description: 'Append a record of each query to a JSON lines file, rotated by size' },
+];
 
 interface Props extends DataSourcePluginOptionsEditorProps<CriblDataSourceOptions, CriblSecureJsonData> {}
 
@@ -92,6 +105,98 @@ export function ConfigEditor(props: Props) {
     }
   };
 
+  const onChangeTimeFields = (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        timeFields: parseFieldList(event.target.value),
+      },
+    });
+  };
+
+  const onChangeMaxChunkJobs = (event: ChangeEvent<HTMLInputElement>) => {
+    const maxChunkJobs = Math.floor(+event.target.value);
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        maxChunkJobs: maxChunkJobs > 0 ? maxChunkJobs : undefined,
+      },
+    });
+  };
+
+  const onChangePositiveNumber = (key: 'maxQueryTimeoutSec' | 'auditFileMaxMb' | 'auditFileMaxFiles' | 'cacheTtlSec' | 'cacheMaxMb' | 'cacheGranularitySec' | 'pollInitialDelaySec' | 'pollMaxBackoffSec' | 'pollJitter') => (event: ChangeEvent<HTMLInputElement>) => {
+    const value = +event.target.value;
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        [key]: value > 0 ? value : undefined,
+      },
+    });
+  };
+
+  const onChangeHideUserInBreadcrumb = (event: React.FormEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        hideUserInBreadcrumb: event.currentTarget.checked || undefined,
+      },
+    });
+  };
+
+  const onChangeAdhocMinRole = (sv: SelectableValue<AdhocRole | ''>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        adhocMinRole: sv.value || undefined,
+      },
+    });
+  };
+
+  const onChangeList = (key: 'adhocUsers' | 'allowedSavedSearchIds' | 'allowedDatasets') => (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        [key]: parseFieldList(event.target.value),
+      },
+    });
+  };
+
+  const onChangeAuditSink = (sv: SelectableValue<AuditSink>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        auditSink: sv.value || undefined,
+      },
+    });
+  };
+
+  const onChangeAuditFilePath = (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        auditFilePath: event.target.value.trim() || undefined,
+      },
+    });
+  };
+
+  const onChangeAuditHashQuery = (event: React.FormEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        auditHashQuery: event.currentTarget.checked || undefined,
+      },
+    });
+  };
+
   const { jsonData, secureJsonFields } = options;
   const secureJsonData = (options.secureJsonData || {}) as CriblSecureJsonData;
 
@@ -136,10 +241,117 @@ export function ConfigEditor(props: Props) {
           onChange={onChangeQueryTimeoutSec}
         />
       </InlineField>
+      <InlineField label="Max Query Timeout" labelWidth={24}
+        tooltip="The longest timeout (seconds) a query may choose for itself.  Also applies when there's no query timeout.  Leave blank for no max.">
+        <Input
+          value={jsonData.maxQueryTimeoutSec ?? ''}
+          placeholder="number of seconds (or blank for no max)"
+          width={54}
+          onChange={onChangePositiveNumber('maxQueryTimeoutSec')}
+        />
+      </InlineField>
+      <InlineField label="Time Fields" labelWidth={24}
+        tooltip="Comma-separated names of fields holding times (epoch seconds, millis, micros, nanos, or RFC3339).  Leave blank to use _time.  Queries can override this.">
+        <Input
+          value={jsonData.timeFields?.join(', ') ?? ''}
+          placeholder="_time"
+          width={54}
+          onChange={onChangeTimeFields}
+        />
+      </InlineField>
+      <InlineField label="Max Chunk Jobs" labelWidth={24}
+        tooltip="When a query's time range is split into chunks, how many jobs may run at once.  Leave blank for the default (4).">
+        <Input
+          value={jsonData.maxChunkJobs ?? ''}
+          placeholder="4"
+          width={54}
+          onChange={onChangeMaxChunkJobs}
+        />
+      </InlineField>
+      <InlineField label="Cache Results" labelWidth={24}
+        tooltip="How long (seconds) to cache query results, so identical queries (i.e. an auto-refreshing dashboard with many viewers) don't each run a job.  Leave blank to disable caching.">
+        <Input
+          value={jsonData.cacheTtlSec ?? ''}
+          placeholder="number of seconds (or blank for no caching)"
+          width={54}
+          onChange={onChangePositiveNumber('cacheTtlSec')}
+        />
+      </InlineField>
+      {!!jsonData.cacheTtlSec && (
+        <>
+          <InlineField label="Cache Size" labelWidth={24} tooltip="Max total size (MB) of cached results">
+            <Input value={jsonData.cacheMaxMb ?? ''} placeholder="100" width={54} onChange={onChangePositiveNumber('cacheMaxMb')} />
+          </InlineField>
+          <InlineField label="Cache Granularity" labelWidth={24}
+            tooltip="Time ranges are rounded to this many seconds, so queries over nearly the same time range share cached results">
+            <Input value={jsonData.cacheGranularitySec ?? ''} placeholder="60" width={54} onChange={onChangePositiveNumber('cacheGranularitySec')} />
+          </InlineField>
+        </>
+      )}
+      <InlineField label="Poll Initial Delay" labelWidth={24} tooltip="How long (seconds) to wait before first checking whether a running job has finished">
+        <Input value={jsonData.pollInitialDelaySec ?? ''} placeholder="0.1" width={54} onChange={onChangePositiveNumber('pollInitialDelaySec')} />
+      </InlineField>
+      <InlineField label="Poll Max Backoff" labelWidth={24} tooltip="Max wait (seconds) between checks of a running job, as the wait grows">
+        <Input value={jsonData.pollMaxBackoffSec ?? ''} placeholder="2" width={54} onChange={onChangePositiveNumber('pollMaxBackoffSec')} />
+      </InlineField>
+      <InlineField label="Poll Jitter" labelWidth={24} tooltip="Randomize each wait by up to +/- this fraction (0 to 1), so queries started together don't poll in lockstep">
+        <Input value={jsonData.pollJitter ?? ''} placeholder="0" width={54} onChange={onChangePositiveNumber('pollJitter')} />
+      </InlineField>
+      <InlineField label="Hide User in Breadcrumb" labelWidth={24}
+        tooltip="Queries are tagged with the org, dashboard, panel and user they came from, so Cribl admins can trace jobs back to them.  Turn this on to leave the user's login out.">
+        <InlineSwitch value={!!jsonData.hideUserInBreadcrumb} onChange={onChangeHideUserInBreadcrumb} />
+      </InlineField>
+      <InlineField label="Ad-hoc Query Role" labelWidth={24}
+        tooltip="Min Grafana org role allowed to run ad-hoc queries, fetch jobs or list the job history.  Everyone else may only run saved searches.">
+        <Select options={ADHOC_ROLE_OPTIONS} value={jsonData.adhocMinRole ?? ''} width={54} onChange={onChangeAdhocMinRole} />
+      </InlineField>
+      <InlineField label="Ad-hoc Query Users" labelWidth={24}
+        tooltip="Comma-separated logins (or emails) of users allowed to run ad-hoc queries whatever their role.  Grafana doesn't tell data sources which teams a user is in, so teams can't be allowed.">
+        <Input value={jsonData.adhocUsers?.join(', ') ?? ''} placeholder="i.e. alice, bob@example.com" width={54} onChange={onChangeList('adhocUsers')} />
+      </InlineField>
+      <InlineField label="Allowed Saved Searches" labelWidth={24} tooltip="Comma-separated IDs of the only saved searches which may be run.  Leave blank to allow any.">
+        <Input value={jsonData.allowedSavedSearchIds?.join(', ') ?? ''} placeholder="any saved search" width={54} onChange={onChangeList('allowedSavedSearchIds')} />
+      </InlineField>
+      <InlineField label="Allowed Datasets" labelWidth={24}
+        tooltip="Comma-separated names (wildcards allowed, i.e. cribl_*) of the only datasets ad-hoc queries may search.  Queries must then pick their datasets with dataset=... or dataset in (...).  Leave blank to allow any.">
+        <Input value={jsonData.allowedDatasets?.join(', ') ?? ''} placeholder="any dataset" width={54} onChange={onChangeList('allowedDatasets')} />
+      </InlineField>
+      <InlineField label="Audit Log" labelWidth={24}
+        tooltip="Keep a record of each query: who ran it, the query, time range, job, status, event count and duration">
+        <Select options={AUDIT_SINK_OPTIONS} value={jsonData.auditSink ?? ''} width={54} onChange={onChangeAuditSink} />
+      </InlineField>
+      {jsonData.auditSink === 'file' && (
+        <>
+          <InlineField label="Audit File" labelWidth={24} tooltip="Path of the JSON lines file to append records to, within the directory the Grafana server sets in GF_PLUGIN_CRIBL_AUDIT_DIR">
+            <Input value={jsonData.auditFilePath ?? ''} placeholder="i.e. cribl-audit.jsonl" width={54} onChange={onChangeAuditFilePath} />
+          </InlineField>
+          <InlineField label="Audit File Size" labelWidth={24} tooltip="Rotate the file once it reaches this size (MB)">
+            <Input value={jsonData.auditFileMaxMb ?? ''} placeholder="100" width={54} onChange={onChangePositiveNumber('auditFileMaxMb')} />
+          </InlineField>
+          <InlineField label="Audit Files Kept" labelWidth={24} tooltip="How many rotated files to keep (at least 1)">
+            <Input value={jsonData.auditFileMaxFiles ?? ''} placeholder="5" width={54} onChange={onChangePositiveNumber('auditFileMaxFiles')} />
+          </InlineField>
+        </>
+      )}
+      {!!jsonData.auditSink && (
+        <InlineField label="Hash Query Text" labelWidth={24} tooltip="Record a SHA-256 hash of each query's text rather than the text itself">
+          <InlineSwitch value={!!jsonData.auditHashQuery} onChange={onChangeAuditHashQuery} />
+        </InlineField>
+      )}
     </>
   );
 }
 
+/**
+ * Parse a comma-separated list of field names
+ * @param value i.e. "_time, timestamp"
+ * @returns the field names, or undefined if there are none
+ */
+export function parseFieldList(value: string): string[] | undefined {
+  const names = value.split(',').map((name) => name.trim()).filter((name) => name.length > 0);
+  return names.length > 0 ? names : undefined;
+}
+
 /**
  * Given any Cribl organization URL, parse it and return the base URL we need for API access
  * @param url any Cribl org URL, with or without a path (it's ignored)
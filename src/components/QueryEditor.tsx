@@ -1,17 +1,42 @@
 import React, { ChangeEvent, KeyboardEvent, useCallback, useEffect, useMemo, useRef, useState } from 'react';
-import { InlineField, Select, Stack, TextArea } from '@grafana/ui';
+import { InlineField, InlineSwitch, Input, Select, Stack, TextArea } from '@grafana/ui';
 import { QueryEditorProps, SelectableValue } from '@grafana/data';
-import { CriblDataSourceOptions, CriblQuery, QueryType } from 'types';
+import { CriblDataSourceOptions, CriblFrameMeta, CriblQuery, FillMode, QueryErrorLocation, QueryType, SavedSearchFreshness, SavedSearchMode } from 'types';
 import { CriblDataSource } from 'datasource';
 import { debounce } from 'lodash';
+import { parseFieldList } from './ConfigEditor';
 
 type Props = QueryEditorProps<CriblDataSource, CriblQuery, CriblDataSourceOptions>;
 
-const QUERY_TYPE_OPTIONS = ['saved', 'adhoc'].map((value) => ({ label: value, value }));
+const QUERY_TYPE_OPTIONS = ['saved', 'adhoc', 'job', 'jobs'].map((value) => ({ label: value, value }));
+const SAVED_SEARCH_MODE_OPTIONS = [
+  { label: 'Cached results', value: 'cached', description: 'Use the results of the latest scheduled run' },
+  { label: 'Re-run (saved range)', value: 'savedRange', description: 'Run the saved query with its own time range' },
+  { label: 'Re-run (dashboard range)', value: 'dashboardRange', description: 'Run the saved query with the dashboard time range' },
+];
+const SAVED_SEARCH_FRESHNESS_OPTIONS = [
+  { label: 'Cached, else run', value: '', description: 'Use cached results if any, otherwise run the search' },
+  { label: 'Max age', value: 'maxAge', description: 'Re-run the search if cached results are too old' },
+  { label: 'Cache only', value: 'cacheOnly', description: 'Fail if there are no cached results' },
+  { label: 'Always run', value: 'always', description: 'Never use cached results' },
+];
+const FILL_MODE_OPTIONS = ['none', 'null', 'zero', 'previous'].map((value) => ({ label: value, value }));
 const DEFAULT_QUERY_TYPE = 'adhoc';
 const DEBOUNCE_RUN_DELAY_MS = 750;
 
-export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props) {
+/**
+ * The line of the query containing the error, with the offending token underlined beneath it
+ */
+export function underlineErrorLocation(query: string, location: QueryErrorLocation): string | undefined {
+  const line = query.split('\n')[location.line - 1]?.replace(/\r$/, '');
+  if (line == null) {
+    return undefined;
+  }
+  const prefix = line.slice(0, location.column - 1).replace(/[^\t]/g, ' '); // keep tabs so the underline lines up
+  return `${line}\n${prefix}^${'~'.repeat(Math.max((location.length ?? 1) - 1, 0))}`;
+}
+
+export function QueryEditor({ datasource, query, onChange, onRunQuery, data }: Props) {
   const currentQueryType = query.type ?? DEFAULT_QUERY_TYPE;
 
   const debouncedOnRunQuery = useRef(debounce(onRunQuery, DEBOUNCE_RUN_DELAY_MS)).current;
@@ -21,13 +46,35 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
   const [queryType, setQueryType] = useState<QueryType>(currentQueryType);
   const [adhocQuery, setAdhocQuery] = useState(currentQueryType === 'adhoc' && 'query' in query ? query.query : '');
 
+  const [jobId, setJobId] = useState(currentQueryType === 'job' && 'jobId' in query ? query.jobId : '');
+
   const onQueryTypeChange = useCallback((sv: SelectableValue<string>) => {
     const newQueryType: QueryType = sv.value as QueryType ?? DEFAULT_QUERY_TYPE;
     setQueryType(newQueryType);
-    newQueryType === 'saved'
-      ? onChange({ ...query, type: 'saved', savedSearchId })
-      : onChange({ ...query, type: 'adhoc', query: adhocQuery });
-  }, [adhocQuery, onChange, query, savedSearchId]);
+    switch (newQueryType) {
+      case 'saved':
+        onChange({ ...query, type: 'saved', savedSearchId });
+        break;
+      case 'job':
+        onChange({ ...query, type: 'job', jobId });
+        break;
+      case 'jobs':
+        onChange({ ...query, type: 'jobs' });
+        break;
+      default:
+        onChange({ ...query, type: 'adhoc', query: adhocQuery });
+    }
+  }, [adhocQuery, jobId, onChange, query, savedSearchId]);
+
+  const onJobsFilterChange = useCallback((key: 'jobsStatus' | 'jobsUser') => (event: ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, type: 'jobs', [key]: event.target.value.trim() || undefined });
+  }, [onChange, query]);
+
+  const onJobIdChange = useCallback((event: ChangeEvent<HTMLInputElement>) => {
+    const newJobId = event.target.value.trim();
+    setJobId(newJobId);
+    onChange({ ...query, type: 'job', jobId: newJobId });
+  }, [onChange, query]);
 
   const onAdhocQueryChange = useCallback((event: ChangeEvent<HTMLTextAreaElement>) => {
     const newQuery = event.target.value;
@@ -36,6 +83,95 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
     // Don't run it automatically, the user can hit Enter or click "Run query" when ready
   }, [onChange, query]);
 
+  const onRelativeTimeRangeChange = useCallback((event: React.FormEvent<HTMLInputElement>) => {
+    onChange({ ...query, type: 'adhoc', query: adhocQuery, relativeTimeRange: event.currentTarget.checked });
+    onRunQuery();
+  }, [adhocQuery, onChange, onRunQuery, query]);
+
+  const [timeFields, setTimeFields] = useState(query.timeFields?.join(', ') ?? '');
+  const onTimeFieldsChange = useCallback((event: ChangeEvent<HTMLInputElement>) => {
+    setTimeFields(event.target.value);
+    onChange({ ...query, timeFields: parseFieldList(event.target.value) });
+  }, [onChange, query]);
+
+  const onSavedSearchModeChange = useCallback((sv: SelectableValue<string>) => {
+    onChange({ ...query, type: 'saved', savedSearchId, savedSearchMode: (sv.value ?? 'cached') as SavedSearchMode });
+    onRunQuery();
+  }, [onChange, onRunQuery, query, savedSearchId]);
+
+  const onSavedSearchFreshnessChange = useCallback((sv: SelectableValue<string>) => {
+    onChange({ ...query, type: 'saved', savedSearchId, savedSearchFreshness: (sv.value ?? '') as SavedSearchFreshness });
+    onRunQuery();
+  }, [onChange, onRunQuery, query, savedSearchId]);
+
+  const onMaxAgeMinutesChange = useCallback((event: ChangeEvent<HTMLInputElement>) => {
+    const maxAgeMinutes = +event.target.value;
+    if (!Number.isNaN(maxAgeMinutes) && maxAgeMinutes >= 0) {
+      onChange({ ...query, type: 'saved', savedSearchId, maxAgeMinutes });
+    }
+  }, [onChange, query, savedSearchId]);
+
+  const onFillModeChange = useCallback((sv: SelectableValue<string>) => {
+    onChange({ ...query, fillMode: (sv.value ?? 'none') as FillMode });
+    onRunQuery();
+  }, [onChange, onRunQuery, query]);
+
+  const [fillInterval, setFillInterval] = useState(query.fillInterval ?? '');
+  const onFillIntervalChange = useCallback((event: ChangeEvent<HTMLInputElement>) => {
+    setFillInterval(event.target.value);
+    onChange({ ...query, fillInterval: event.target.value.trim() || undefined });
+  }, [onChange, query]);
+
+  const [chunkInterval, setChunkInterval] = useState((query.type === 'adhoc' && query.chunkInterval) || '');
+  const onChunkIntervalChange = useCallback((event: ChangeEvent<HTMLInputElement>) => {
+    setChunkInterval(event.target.value);
+    onChange({ ...query, type: 'adhoc', query: adhocQuery, chunkInterval: event.target.value.trim() || undefined });
+  }, [adhocQuery, onChange, query]);
+
+  const onIncrementalChange = useCallback((event: React.FormEvent<HTMLInputElement>) => {
+    onChange({ ...query, type: 'adhoc', query: adhocQuery, incremental: event.currentTarget.checked || undefined });
+    onRunQuery();
+  }, [adhocQuery, onChange, onRunQuery, query]);
+
+  const onPartialResultsChange = useCallback((event: React.FormEvent<HTMLInputElement>) => {
+    onChange({ ...query, partialResults: event.currentTarget.checked || undefined });
+    onRunQuery();
+  }, [onChange, onRunQuery, query]);
+
+  const onTimeoutSecChange = useCallback((event: ChangeEvent<HTMLInputElement>) => {
+    const timeoutSec = +event.target.value;
+    onChange({ ...query, timeoutSec: timeoutSec > 0 ? timeoutSec : undefined });
+  }, [onChange, query]);
+
+  const [jobTags, setJobTags] = useState(query.jobTags?.join(', ') ?? '');
+  const onJobTagsChange = useCallback((event: ChangeEvent<HTMLInputElement>) => {
+    setJobTags(event.target.value);
+    const tags = event.target.value.split(',').map((tag) => tag.trim()).filter((tag) => tag.length > 0);
+    onChange({ ...query, jobTags: tags.length > 0 ? tags : undefined });
+  }, [onChange, query]);
+
+  const onBypassCacheChange = useCallback((event: React.FormEvent<HTMLInputElement>) => {
+    onChange({ ...query, bypassCache: event.currentTarget.checked || undefined });
+    onRunQuery();
+  }, [onChange, onRunQuery, query]);
+
+  const onStreamChange = useCallback((event: React.FormEvent<HTMLInputElement>) => {
+    onChange({ ...query, stream: event.currentTarget.checked });
+    onRunQuery();
+  }, [onChange, onRunQuery, query]);
+
+  const onTailChange = useCallback((event: React.FormEvent<HTMLInputElement>) => {
+    onChange({ ...query, type: 'adhoc', query: adhocQuery, tail: event.currentTarget.checked });
+    onRunQuery();
+  }, [adhocQuery, onChange, onRunQuery, query]);
+
+  const onTailIntervalChange = useCallback((event: ChangeEvent<HTMLInputElement>) => {
+    const tailIntervalSec = +event.target.value;
+    if (!Number.isNaN(tailIntervalSec) && tailIntervalSec >= 0) {
+      onChange({ ...query, type: 'adhoc', query: adhocQuery, tailIntervalSec: tailIntervalSec || undefined });
+    }
+  }, [adhocQuery, onChange, query]);
+
   const onAdhocQueryKeyDown = useCallback((event: KeyboardEvent<HTMLTextAreaElement>) => {
     if (event.key === 'Enter' && !event.shiftKey) { // allow shift-enter to add a line break
       event.preventDefault();
@@ -72,6 +208,17 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
     loadSavedSearchIds();
   }, [datasource]);
 
+  // If Cribl rejected the ad-hoc query and said where, point it out beneath the query
+  const errorLocation = useMemo(() => {
+    const frame = data?.series.find((f) => f.refId === query.refId);
+    const location = (frame?.meta?.custom as CriblFrameMeta | undefined)?.errorLocation;
+    if (location == null || queryType !== 'adhoc') {
+      return undefined;
+    }
+    const message = data?.errors?.find((e) => e.refId === query.refId)?.message ?? data?.error?.message;
+    return { location, message, underlined: underlineErrorLocation(adhocQuery, location) };
+  }, [adhocQuery, data, query.refId, queryType]);
+
   const QueryFields = useMemo(() => {
     if (queryType === 'saved') {
       return (
@@ -84,9 +231,36 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
             width={24} />
         </InlineField>
       );
+    } else if (queryType === 'jobs') {
+      return (
+        <>
+          <InlineField label="Status" labelWidth={10} tooltip="Only list jobs with this status, i.e. completed">
+            <Input defaultValue={query.type === 'jobs' ? query.jobsStatus : ''} placeholder="any" width={16} onChange={onJobsFilterChange('jobsStatus')} onBlur={onRunQuery} />
+          </InlineField>
+          <InlineField label="User" labelWidth={8} tooltip="Only list jobs run by this user">
+            <Input defaultValue={query.type === 'jobs' ? query.jobsUser : ''} placeholder="any" width={24} onChange={onJobsFilterChange('jobsUser')} onBlur={onRunQuery} />
+          </InlineField>
+        </>
+      );
+    } else if (queryType === 'job') {
+      return (
+        <InlineField label="Job ID" labelWidth={10} tooltip="ID of an existing Cribl Search job, i.e. one started from the Cribl UI">
+          <Input value={jobId} placeholder="i.e. 1728744793123.AbCdEf" width={32} onChange={onJobIdChange} onBlur={onRunQuery} />
+        </InlineField>
+      );
     } else {
       return (
-        <InlineField label="Query" labelWidth={10} tooltip="Cribl Search query (Kusto)">
+        <InlineField
+          label="Query"
+          labelWidth={10}
+          tooltip="Cribl Search query (Kusto)"
+          invalid={!!errorLocation}
+          error={errorLocation && (
+            <>
+              Line {errorLocation.location.line}, column {errorLocation.location.column}: {errorLocation.message}
+              {errorLocation.underlined && <pre>{errorLocation.underlined}</pre>}
+            </>
+          )}>
           <TextArea
             onChange={onAdhocQueryChange}
             onKeyDown={onAdhocQueryKeyDown}
@@ -99,7 +273,9 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
         </InlineField>
       );
     }
-  }, [adhocQuery, onAdhocQueryChange, onAdhocQueryKeyDown, onSavedQueryIdChange, queryType, savedSearchId, savedSearchIdOptions]);
+  }, [adhocQuery, errorLocation, jobId, onAdhocQueryChange, onAdhocQueryKeyDown, onJobIdChange, onJobsFilterChange, onRunQuery, onSavedQueryIdChange, query, queryType, savedSearchId, savedSearchIdOptions]);
+
+  const relativeTimeRange = query.type === 'adhoc' && !!query.relativeTimeRange;
 
   return (
     <Stack gap={0}>
@@ -107,6 +283,90 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
         <Select onChange={onQueryTypeChange} options={QUERY_TYPE_OPTIONS} value={queryType} width={24} />
       </InlineField>
       {QueryFields}
+      <InlineField label="Time Fields" labelWidth={16} tooltip="Comma-separated names of fields holding times, overriding the data source's default">
+        <Input value={timeFields} placeholder="default" width={24} onChange={onTimeFieldsChange} onBlur={onRunQuery} />
+      </InlineField>
+      <InlineField label="Fill Missing" labelWidth={16} tooltip="How to fill time buckets with no results, for summarized time series">
+        <Select onChange={onFillModeChange} options={FILL_MODE_OPTIONS} value={query.fillMode ?? 'none'} width={16} />
+      </InlineField>
+      {(query.fillMode ?? 'none') !== 'none' && (
+        <InlineField label="Fill Interval" labelWidth={16} tooltip="Bucket interval, i.e. 5m.  Leave blank to detect it from bin() in the query.">
+          <Input value={fillInterval} placeholder="auto" width={16} onChange={onFillIntervalChange} onBlur={onRunQuery} />
+        </InlineField>
+      )}
+      {queryType === 'saved' && (
+        <InlineField label="Mode" labelWidth={8} tooltip="Whether to use cached scheduled results, or re-run the saved search">
+          <Select
+            onChange={onSavedSearchModeChange}
+            options={SAVED_SEARCH_MODE_OPTIONS}
+            value={(query.type === 'saved' && query.savedSearchMode) || 'cached'}
+            width={28} />
+        </InlineField>
+      )}
+      {queryType === 'saved' && query.type === 'saved' && (query.savedSearchMode ?? 'cached') === 'cached' && (
+        <InlineField label="Freshness" labelWidth={12} tooltip="What to do when cached results are stale or missing">
+          <Select
+            onChange={onSavedSearchFreshnessChange}
+            options={SAVED_SEARCH_FRESHNESS_OPTIONS}
+            value={query.savedSearchFreshness ?? ''}
+            width={20} />
+        </InlineField>
+      )}
+      {query.type === 'saved' && query.savedSearchFreshness === 'maxAge' && (
+        <InlineField label="Max Age (min)" labelWidth={16} tooltip="Required, re-run the search if its cached results are older than this" invalid={(query.maxAgeMinutes ?? 0) <= 0}>
+          <Input type="number" value={query.maxAgeMinutes ?? ''} width={10} onChange={onMaxAgeMinutesChange} onBlur={onRunQuery} />
+        </InlineField>
+      )}
+      {queryType !== 'jobs' && (
+        <InlineField label="Stream" labelWidth={10} tooltip="Show results progressively while the job runs, rather than waiting for it to finish">
+          <InlineSwitch value={!!query.stream} onChange={onStreamChange} />
+        </InlineField>
+      )}
+      {queryType !== 'jobs' && (
+        <InlineField label="Partial on Timeout" labelWidth={18} tooltip="If the query times out, show the results produced so far (with a warning) rather than an error">
+          <InlineSwitch value={!!query.partialResults} onChange={onPartialResultsChange} />
+        </InlineField>
+      )}
+      {queryType !== 'jobs' && (
+        <InlineField label="Timeout (sec)" labelWidth={14} tooltip="Override the data source's query timeout for this query (up to the data source's max).  Leave blank for the default.">
+          <Input type="number" value={query.timeoutSec ?? ''} placeholder="default" width={10} onChange={onTimeoutSecChange} onBlur={onRunQuery} />
+        </InlineField>
+      )}
+      {queryType !== 'jobs' && (
+        <InlineField label="Job Tags" labelWidth={10} tooltip="Comma-separated tags added to the query, so its jobs can be told apart in Cribl's job history">
+          <Input value={jobTags} placeholder="none" width={20} onChange={onJobTagsChange} onBlur={onRunQuery} />
+        </InlineField>
+      )}
+      {queryType !== 'jobs' && (
+        <InlineField label="Bypass Cache" labelWidth={14} tooltip="Always run the query, rather than using cached results (if the data source caches results)">
+          <InlineSwitch value={!!query.bypassCache} onChange={onBypassCacheChange} />
+        </InlineField>
+      )}
+      {queryType === 'adhoc' && (
+        <InlineField label="Incremental" labelWidth={12} tooltip="On refresh, only query time buckets since the last refresh, keeping earlier buckets.  Requires bin() in the query.">
+          <InlineSwitch value={query.type === 'adhoc' && !!query.incremental} onChange={onIncrementalChange} />
+        </InlineField>
+      )}
+      {queryType === 'adhoc' && (
+        <InlineField label="Chunk Size" labelWidth={12} tooltip="Split long time ranges into chunks of this size (i.e. 1d), run as concurrent jobs.  Leave blank to run a single job.">
+          <Input value={chunkInterval} placeholder="none" width={12} onChange={onChunkIntervalChange} onBlur={onRunQuery} />
+        </InlineField>
+      )}
+      {queryType === 'adhoc' && (
+        <InlineField label="Live Tail" labelWidth={12} tooltip="Continuously show new events as they arrive, like tail -f">
+          <InlineSwitch value={query.type === 'adhoc' && !!query.tail} onChange={onTailChange} />
+        </InlineField>
+      )}
+      {query.type === 'adhoc' && query.tail && (
+        <InlineField label="Every (sec)" labelWidth={12} tooltip="How often to poll for new events">
+          <Input type="number" value={query.tailIntervalSec ?? ''} placeholder="5" width={8} onChange={onTailIntervalChange} onBlur={onRunQuery} />
+        </InlineField>
+      )}
+      {queryType === 'adhoc' && (
+        <InlineField label="Relative Time" labelWidth={16} tooltip="Send relative times (i.e. -1h to now) to Cribl when the dashboard uses a relative range, so cached results can be reused across refreshes">
+          <InlineSwitch value={relativeTimeRange} onChange={onRelativeTimeRangeChange} />
+        </InlineField>
+      )}
     </Stack>
   );
 }
@@ -1,5 +1,6 @@
-import { DataSourceInstanceSettings, CoreApp, ScopedVars } from "@grafana/data";
-import { DataSourceWithBackend, getTemplateSrv } from "@grafana/runtime";
+import { AdHocVariableFilter, DataQueryRequest, DataQueryResponse, DataSourceGetTagKeysOptions, DataSourceGetTagValuesOptions, DataSourceInstanceSettings, CoreApp, DateTime, LiveChannelScope, MetricFindValue, ScopedVars } from "@grafana/data";
+import { DataSourceWithBackend, getGrafanaLiveSrv, getTemplateSrv } from "@grafana/runtime";
+import { from, merge, Observable, switchMap } from "rxjs";
 import { CriblQuery, CriblDataSourceOptions, DEFAULT_QUERY } from "types";
 
 export class CriblDataSource extends DataSourceWithBackend<CriblQuery, CriblDataSourceOptions> {
@@ -11,13 +12,47 @@ export class CriblDataSource extends DataSourceWithBackend<CriblQuery, CriblData
     return DEFAULT_QUERY;
   }
 
-  applyTemplateVariables(criblQuery: CriblQuery, scopedVars: ScopedVars) {
+  query(request: DataQueryRequest<CriblQuery>): Observable<DataQueryResponse> {
+    // The backend only sees absolute times, so pass along the raw range for queries that want relative times
+    const raw = (t: DateTime | string) => typeof t === 'string' ? t : t.toISOString();
+    const timeRangeRaw = { from: raw(request.range.raw.from), to: raw(request.range.raw.to) };
+    const targets = request.targets.map((target) => target.type === 'adhoc' && target.relativeTimeRange ? { ...target, timeRangeRaw } : target);
+
+    // Streaming & live tail queries are subscribed to over Grafana Live, everything else goes through the regular query path
+    const isTail = (target: CriblQuery) => target.type === 'adhoc' && !!target.tail;
+    const streamTargets = targets.filter((target) => (target.stream || isTail(target)) && !target.hide && target.type !== 'jobs');
+    const regularTargets = targets.filter((target) => !streamTargets.includes(target));
+    const observables: Array<Observable<DataQueryResponse>> = streamTargets.map((target) => {
+      const id = `${request.requestId}-${target.refId}`;
+      const data = {
+        ...this.applyTemplateVariables(target, request.scopedVars, request.filters),
+        // A live tail starts from a short lookback, rather than the whole time range
+        from: isTail(target) ? undefined : request.range.from.valueOf(),
+        to: request.range.to.valueOf(),
+      };
+      // The backend issues the channel path, bound to the query and the user, so nobody else can join the stream
+      return from(this.postResource<{ path: string }>('streamPath', { kind: isTail(target) ? 'tail' : 'query', id, data })).pipe(
+        switchMap(({ path }) => getGrafanaLiveSrv().getDataStream({
+          key: id,
+          addr: { scope: LiveChannelScope.DataSource, namespace: this.uid, path, data },
+        }))
+      );
+    });
+    if (regularTargets.length > 0 || observables.length === 0) {
+      observables.push(super.query({ ...request, targets: regularTargets }));
+    }
+    return merge(...observables);
+  }
+
+  applyTemplateVariables(criblQuery: CriblQuery, scopedVars: ScopedVars, filters?: AdHocVariableFilter[]) {
     switch (criblQuery.type) {
       case 'adhoc':
         return {
           ...criblQuery,
           // You can use dashboard variables in your query
           query: getTemplateSrv().replace(criblQuery.query, scopedVars),
+          // Ad hoc filters are turned into "where" clauses by the backend
+          adhocFilters: (filters ?? []).map(({ key, operator, value }) => ({ key, operator, value })),
         };
       case 'saved':
         return {
@@ -25,6 +60,17 @@ export class CriblDataSource extends DataSourceWithBackend<CriblQuery, CriblData
           // The savedSearchId can also be composed using dashboard variable(s)
           savedSearchId: getTemplateSrv().replace(criblQuery.savedSearchId, scopedVars),
         };
+      case 'job':
+        return {
+          ...criblQuery,
+          jobId: getTemplateSrv().replace(criblQuery.jobId, scopedVars),
+        };
+      case 'jobs':
+        return {
+          ...criblQuery,
+          jobsStatus: getTemplateSrv().replace(criblQuery.jobsStatus ?? '', scopedVars),
+          jobsUser: getTemplateSrv().replace(criblQuery.jobsUser ?? '', scopedVars),
+        };
       default: // exhaustive check
         throw new Error(`Unexpected query type`);
     }
@@ -38,12 +84,42 @@ export class CriblDataSource extends DataSourceWithBackend<CriblQuery, CriblData
     return await this.getResource('savedSearchIds');
   }
 
+  async getTagKeys(options?: DataSourceGetTagKeysOptions<CriblQuery>): Promise<MetricFindValue[]> {
+    const keys: string[] = await this.getResource('tagKeys', this.tagQueryParams(options));
+    return keys.map((text) => ({ text }));
+  }
+
+  async getTagValues(options: DataSourceGetTagValuesOptions<CriblQuery>): Promise<MetricFindValue[]> {
+    const values: string[] = await this.getResource('tagValues', { key: options.key, ...this.tagQueryParams(options) });
+    return values.map((text) => ({ text }));
+  }
+
+  /**
+   * Sample events for the ad hoc filter UI using the first ad-hoc query on the dashboard (if any) and its time range
+   */
+  private tagQueryParams(options?: DataSourceGetTagKeysOptions<CriblQuery>): Record<string, string> {
+    const params: Record<string, string> = {};
+    const adhocQuery = options?.queries?.find((q) => q.type === 'adhoc' && q.query?.trim().length > 0);
+    if (adhocQuery?.type === 'adhoc') {
+      params.query = getTemplateSrv().replace(adhocQuery.query);
+    }
+    if (options?.timeRange) {
+      params.earliest = `${options.timeRange.from.valueOf() / 1000}`;
+      params.latest = `${options.timeRange.to.valueOf() / 1000}`;
+    }
+    return params;
+  }
+
   private canRunQuery(criblQuery: CriblQuery): boolean {
     switch (criblQuery.type) {
       case 'adhoc':
         return (criblQuery.query?.trim() ?? '').length > 0;
       case 'saved':
         return criblQuery.savedSearchId != null;
+      case 'job':
+        return (criblQuery.jobId?.trim() ?? '').length > 0;
+      case 'jobs':
+        return true;
       default:
         return false;
     }
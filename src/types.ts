@@ -4,27 +4,170 @@ import { DataQuery } from '@grafana/schema';
 /**
  * Possible values of CriblQuery.type
  */
-export type QueryType = 'adhoc' | 'saved';
+export type QueryType = 'adhoc' | 'saved' | 'job' | 'jobs';
 
 /**
- * Query used with Cribl Search.  Can either use a saved search or run an adhoc query.
+ * Possible values of CriblQuery.savedSearchMode
  */
-export type CriblQuery = DataQuery & (
+export type SavedSearchMode = 'cached' | 'savedRange' | 'dashboardRange';
+
+/**
+ * Possible values of CriblQuery.savedSearchFreshness ('' means use cached results if any, otherwise run the search)
+ */
+export type SavedSearchFreshness = '' | 'maxAge' | 'cacheOnly' | 'always';
+
+/**
+ * Possible values of CriblQuery.fillMode
+ */
+export type FillMode = 'none' | 'null' | 'zero' | 'previous';
+
+/**
+ * A single filter from a Grafana ad hoc filter variable
+ */
+export interface AdhocFilter {
+  key: string;
+  operator: string;
+  value: string;
+}
+
+/**
+ * Query used with Cribl Search.  Can either use a saved search, run an adhoc query, fetch the results of an existing job,
+ * or list the search job history.
+ */
+export type CriblQuery = DataQuery & {
+  /**
+   * Names of fields to convert to time values, overriding the data source's default
+   */
+  timeFields?: string[];
+  /**
+   * How to fill time buckets missing from summarized results
+   */
+  fillMode?: FillMode;
+  /**
+   * Bucket interval used for filling (i.e. "5m"), detected from bin() in the query if omitted
+   */
+  fillInterval?: string;
+  /**
+   * Stream results progressively over Grafana Live while the job runs
+   */
+  stream?: boolean;
+  /**
+   * Always run the query, neither using nor updating the data source's result cache
+   */
+  bypassCache?: boolean;
+  /**
+   * On timeout, return the results produced so far (with a warning) instead of an error
+   */
+  partialResults?: boolean;
+  /**
+   * Overrides the data source's query timeout (seconds), capped by its max
+   */
+  timeoutSec?: number;
+  /**
+   * Tags added to the query's breadcrumb, identifying its jobs in Cribl's job history
+   */
+  jobTags?: string[];
+} & (
   {
     type: 'adhoc';
     /**
      * Ad-hoc query (Kusto)
      */
     query: string;
+    /**
+     * Grafana ad hoc filters, applied by the backend as "where" clauses
+     */
+    adhocFilters?: AdhocFilter[];
+    /**
+     * Pass the dashboard's relative time range (i.e. "-1h" to "now") to Cribl, rather than absolute times
+     */
+    relativeTimeRange?: boolean;
+    /**
+     * The dashboard's raw time range, supplied automatically when the query runs
+     */
+    timeRangeRaw?: { from: string; to: string };
+    /**
+     * Live tail the query, like "tail -f", pushing new events as they arrive
+     */
+    tail?: boolean;
+    /**
+     * How often (seconds) a live tail polls for new events
+     */
+    tailIntervalSec?: number;
+    /**
+     * On refresh, only query the time buckets since the last refresh, merging them with the previous results (requires bin())
+     */
+    incremental?: boolean;
+    /**
+     * Split the time range into chunks of this size (i.e. "1d"), run as concurrent jobs
+     */
+    chunkInterval?: string;
   } | {
     type: 'saved';
     /**
      * ID of the Cribl saved search
      */
     savedSearchId: string;
+    /**
+     * Use the cached scheduled results (default), or re-run the saved search with its own or the dashboard's time range
+     */
+    savedSearchMode?: SavedSearchMode;
+    /**
+     * When using cached results: whether to re-run stale results, fail without cached results, or always re-run
+     */
+    savedSearchFreshness?: SavedSearchFreshness;
+    /**
+     * How old (minutes) cached results may be, when savedSearchFreshness is "maxAge"
+     */
+    maxAgeMinutes?: number;
+  } | {
+    type: 'job';
+    /**
+     * ID of an existing Cribl job, i.e. one started from the Cribl UI
+     */
+    jobId: string;
+  } | {
+    type: 'jobs';
+    /**
+     * Only list jobs with this status, i.e. "completed"
+     */
+    jobsStatus?: string;
+    /**
+     * Only list jobs run by this user
+     */
+    jobsUser?: string;
   }
 );
 
+/**
+ * Grafana org roles which may be required to run ad-hoc queries
+ */
+export type AdhocRole = 'Viewer' | 'Editor' | 'Admin';
+
+/**
+ * Where audit records of queries are written, if anywhere
+ */
+export type AuditSink = '' | 'log' | 'file';
+
+/**
+ * Where Cribl found an error in an ad-hoc query, in terms of the query as written (1-based)
+ */
+export interface QueryErrorLocation {
+  line: number;
+  column: number;
+  /**
+   * Length of the offending token, if known
+   */
+  length?: number;
+}
+
+/**
+ * Custom frame metadata from the backend (only the parts the UI cares about)
+ */
+export interface CriblFrameMeta {
+  errorLocation?: QueryErrorLocation;
+}
+
 /**
  * Default query with which we pre-populate the UI
  */
@@ -49,6 +192,83 @@ export interface CriblDataSourceOptions extends DataSourceJsonData {
    * How long we're willing to wait for a query to run before giving up on it.
    */
   queryTimeoutSec?: number;
+  /**
+   * The longest timeout (seconds) a query may choose for itself.  Also caps queries when there's no default timeout.
+   */
+  maxQueryTimeoutSec?: number;
+  /**
+   * Default names of fields to convert to time values (epoch s/ms/µs/ns or RFC3339), i.e. "_time"
+   */
+  timeFields?: string[];
+  /**
+   * Max # of concurrent jobs when a query's time range is split into chunks
+   */
+  maxChunkJobs?: number;
+  /**
+   * How long (seconds) query results are cached.  Caching is disabled if not set.
+   */
+  cacheTtlSec?: number;
+  /**
+   * Max total size (MB) of cached results
+   */
+  cacheMaxMb?: number;
+  /**
+   * Time ranges are rounded to this many seconds for caching, so near-identical ranges share results
+   */
+  cacheGranularitySec?: number;
+  /**
+   * How long (seconds) to wait before first polling a running job's status
+   */
+  pollInitialDelaySec?: number;
+  /**
+   * Max wait (seconds) between polls of a running job's status, as the wait grows
+   */
+  pollMaxBackoffSec?: number;
+  /**
+   * Randomize each wait between polls by up to +/- this fraction (0 to 1)
+   */
+  pollJitter?: number;
+  /**
+   * Leave the Grafana user's login out of the breadcrumb appended to queries
+   */
+  hideUserInBreadcrumb?: boolean;
+  /**
+   * Min Grafana org role allowed to run ad-hoc queries (and fetch jobs or the job history).  Anyone can if neither
+   * this nor adhocUsers is set, everyone else is restricted to saved searches.
+   */
+  adhocMinRole?: AdhocRole;
+  /**
+   * Logins (or emails) of users allowed to run ad-hoc queries regardless of their role
+   */
+  adhocUsers?: string[];
+  /**
+   * If set, the only saved searches which may be run
+   */
+  allowedSavedSearchIds?: string[];
+  /**
+   * If set, the only datasets ad-hoc queries may search (wildcards allowed)
+   */
+  allowedDatasets?: string[];
+  /**
+   * Where to write a record of each query: nowhere (unset), the plugin log, or a JSON lines file
+   */
+  auditSink?: AuditSink;
+  /**
+   * For the file sink, the JSON lines file to append to (on the Grafana server)
+   */
+  auditFilePath?: string;
+  /**
+   * Rotate the audit file once it reaches this size (MB)
+   */
+  auditFileMaxMb?: number;
+  /**
+   * # of rotated audit files kept
+   */
+  auditFileMaxFiles?: number;
+  /**
+   * Record a hash of the query text rather than the text itself
+   */
+  auditHashQuery?: boolean;
 }
 
 /**